@@ -38,15 +38,50 @@ func (*AdminController) Controller(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// POST handles the HTTP POST request and routes it to the appropriate service based on the URL path.
+// POST handles the HTTP POST request and routes it to the appropriate service based on the URL path, once its CSRF token is validated.
 func (*AdminController) POST(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/admin")
 
+	if path == "/upload" && !services.Admin.LimitUpload(w, r) {
+		return
+	}
+	if !validCSRF(w, r) {
+		return
+	}
+
 	switch path {
 	case "/upload":
 		services.Admin.UploadStudentsList(w, r)
+	case "/upload/confirm":
+		services.Admin.ConfirmStudentsList(w, r)
 	case "/export":
-		services.Admin.ExportAttendanceCSV(w, r)
+		services.Admin.ExportAttendance(w, r)
+	case "/sessions/revoke":
+		services.Admin.RevokeSessions(w, r)
+	case "/schedules":
+		services.Admin.CreateSchedule(w, r)
+	case "/schedules/delete":
+		services.Admin.DeleteSchedule(w, r)
+	case "/users/role":
+		services.Admin.SetUserRole(w, r)
+	case "/users/unlock":
+		services.Admin.UnlockLogin(w, r)
+	case "/users/password":
+		services.Admin.ClearPassword(w, r)
+	case "/users/2fa":
+		services.Admin.ResetTwoFactor(w, r)
+	case "/users/active":
+		services.Admin.SetUserActive(w, r)
+	case "/locations":
+		services.Admin.CreateLocation(w, r)
+	case "/locations/delete":
+		services.Admin.DeleteLocation(w, r)
+	case "/courses":
+		services.Admin.CreateCourse(w, r)
+	case "/courses/delete":
+		services.Admin.DeleteCourse(w, r)
+	case "/courses/instructors":
+		services.Admin.SetCourseInstructors(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -61,8 +96,22 @@ func (*AdminController) GET(w http.ResponseWriter, r *http.Request) {
 		fallthrough
 	case "/success":
 		fallthrough
+	case "/sessions":
+		fallthrough
+	case "/schedules":
+		fallthrough
+	case "/locations":
+		fallthrough
+	case "/courses":
+		fallthrough
+	case "/users":
+		fallthrough
+	case "/audit":
+		fallthrough
 	case "/overview":
 		services.Admin.Index(w, r)
+	case "/kiosk":
+		services.Admin.Kiosk(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"attendance.com/src/services"
+)
+
+// APIController handles HTTP request handling for the versioned JSON API.
+type APIController struct{}
+
+var (
+	// API is an instance of APIController.
+	API APIController
+)
+
+// Controller routes the HTTP request to the appropriate method based on the HTTP method.
+func (*APIController) Controller(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		API.POST(w, r)
+	case http.MethodGet:
+		API.GET(w, r)
+	default:
+		services.API.NotFound(w, r)
+	}
+}
+
+// POST handles the HTTP POST request and routes it to the appropriate service based on the URL path.
+func (*APIController) POST(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+
+	switch path {
+	case "/auth/login":
+		services.API.Login(w, r)
+	case "/auth/logout":
+		services.API.Logout(w, r)
+	case "/attendance/checkin":
+		services.API.CheckIn(w, r)
+	case "/attendance/checkout":
+		services.API.CheckOut(w, r)
+	case "/users/upload":
+		services.API.UploadUsers(w, r)
+	default:
+		services.API.NotFound(w, r)
+	}
+}
+
+// GET handles the HTTP GET request and routes it to the appropriate service based on the URL path.
+func (*APIController) GET(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+
+	switch path {
+	case "/me":
+		services.API.Me(w, r)
+	case "/users":
+		services.API.Users(w, r)
+	case "/attendance":
+		services.API.Attendance(w, r)
+	default:
+		services.API.NotFound(w, r)
+	}
+}
@@ -31,8 +31,12 @@ func (*AuthController) Controller(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// POST routes the POST requests to the appropriate services
+// POST routes the POST requests to the appropriate services, once their CSRF token is validated
 func (*AuthController) POST(w http.ResponseWriter, r *http.Request) {
+	if !validCSRF(w, r) {
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/auth")
 
 	switch path {
@@ -42,6 +46,22 @@ func (*AuthController) POST(w http.ResponseWriter, r *http.Request) {
 		services.Auth.Logout(w, r)
 	case "/register":
 		services.Auth.Register(w, r)
+	case "/register/code":
+		services.Auth.SendVerificationCode(w, r)
+	case "/password":
+		services.Auth.ChangePassword(w, r)
+	case "/forgot":
+		services.Auth.RequestPasswordReset(w, r)
+	case "/reset":
+		services.Auth.ResetPassword(w, r)
+	case "/2fa/enable":
+		services.Auth.EnableTwoFactor(w, r)
+	case "/2fa/recovery":
+		services.Auth.RegenerateRecoveryCodes(w, r)
+	case "/2fa/disable":
+		services.Auth.DisableTwoFactor(w, r)
+	case "/2fa/verify":
+		services.Auth.VerifyTwoFactor(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -54,8 +74,30 @@ func (*AuthController) GET(w http.ResponseWriter, r *http.Request) {
 	switch path {
 	case "/success":
 		fallthrough
+	case "/password":
+		fallthrough
+	case "/password/changed":
+		fallthrough
+	case "/forgot":
+		fallthrough
+	case "/forgot/sent":
+		fallthrough
+	case "/reset":
+		fallthrough
+	case "/reset/done":
+		fallthrough
+	case "/register/code":
+		fallthrough
 	case "/register":
 		services.Auth.RegisterPage(w, r)
+	case "/2fa":
+		fallthrough
+	case "/2fa/verify":
+		services.Auth.TwoFactorPage(w, r)
+	case "/oidc/login":
+		services.Auth.OIDCLogin(w, r)
+	case "/oidc/callback":
+		services.Auth.OIDCCallback(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"net/http"
+
+	"attendance.com/src/services"
+)
+
+// validCSRF guards form submissions against cross-site request forgery.
+// Requests that do not submit the CSRF token of their session are rejected with a forbidden response.
+func validCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if !services.Auth.ValidCSRF(r) {
+		http.Error(w, "Invalid or missing CSRF token, reload the page and try again.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
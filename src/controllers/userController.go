@@ -31,13 +31,21 @@ func (*UserController) Controller(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// POST routes HTTP POST requests to the appropriate services.
+// POST routes HTTP POST requests to the appropriate services, once their CSRF token is validated.
 func (*UserController) POST(w http.ResponseWriter, r *http.Request) {
+	if !validCSRF(w, r) {
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/user")
 
 	switch path {
 	case "/attendance":
 		services.Usr.CheckIn(w, r)
+	case "/attendance/checkout":
+		services.Usr.CheckOut(w, r)
+	case "/attendance/kiosk":
+		services.Usr.KioskCheckIn(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -50,6 +58,8 @@ func (*UserController) GET(w http.ResponseWriter, r *http.Request) {
 	switch path {
 	case "/attendance/success":
 		services.Usr.CheckInSuccess(w, r)
+	case "/attendance/checkout/success":
+		services.Usr.CheckOutSuccess(w, r)
 	default:
 		http.NotFound(w, r)
 	}
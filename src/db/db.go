@@ -1,56 +1,108 @@
 /*
-Package db provides functionality for reading and writing JSON data to and from files.
+Package db provides the persistence layer of the application.
 
-The db package includes methods for reading and writing JSON data to files. It utilizes the encoding/json package for marshaling and unmarshaling JSON.
+The db package exposes a Store interface for reading and writing users, sessions and attendance records.
+Two drivers are provided and selected through the APP_DB_DRIVER env:
+
+  - json: the default, keeps each collection in a JSON document under APP_DB_PATH.
+  - sqlite: an embedded SQL database located at APP_DB_DSN.
+
+The package also includes the Read and Write helpers used by the JSON driver. They utilize the encoding/json package for marshaling and unmarshaling JSON.
 */
 package db
 
 import (
 	"encoding/json"
 	"errors"
-
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"attendance.com/src/logger"
 )
 
+// ErrEmptyDocument is returned by Read when the requested file has no content.
+var ErrEmptyDocument = errors.New("empty document")
+
 // The Read function reads JSON data from a specified file path and unmarshals it into the provided payload.
 // It returns an error if the file cannot be read, is empty, or if unmarshalling fails.
 func Read(filePath string, payload interface{}) error {
 	bs, err := os.ReadFile(os.Getenv("APP_DB_PATH") + filePath)
-	logger.Println(os.Getenv("APP_DB_PATH") + filePath)
 	if err != nil {
-		logger.Println(err)
-		panic(errors.New("unable to read from file:" + filePath))
+		return fmt.Errorf("unable to read from file %s: %w", filePath, err)
 	}
 
 	if len(bs) == 0 {
-		return errors.New("empty document")
+		return ErrEmptyDocument
 	}
 
 	err = json.Unmarshal(bs, payload)
 	if err != nil {
-		logger.Println(err)
-		panic(errors.New("unmarshalling JSON failed"))
+		return fmt.Errorf("unmarshalling %s failed: %w", filePath, err)
 	}
 
 	return nil
 }
 
 // The Write function marshals the provided payload into JSON format and writes it to the specified file path.
+// The file is replaced atomically: the JSON is written and synced to a temporary file in the same folder which is then renamed over the target,
+// so a crash mid-write leaves either the old or the new document, never a truncated one.
 // It returns an error if marshalling fails or if the file cannot be written.
 func Write(payload interface{}, filePath string) error {
 	bs, err := json.MarshalIndent(payload, "", "  ")
 	if err != nil {
 		logger.Println(err)
-		panic(errors.New("marshalling JSON failed"))
+		return fmt.Errorf("marshalling %s failed: %w", filePath, err)
 	}
 
-	err = os.WriteFile(os.Getenv("APP_DB_PATH")+filePath, bs, 0644)
+	err = writeFileAtomic(os.Getenv("APP_DB_PATH")+filePath, bs)
 	if err != nil {
 		logger.Println(err)
-		panic(errors.New("unable to write to file:" + filePath))
+		return fmt.Errorf("unable to write to file %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
 	}
+	// Clean up the temporary file on failure, a no-op once it has been renamed
+	defer os.Remove(tmp.Name())
 
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	syncDir(dir)
 	return nil
 }
+
+// syncDir persists the rename of a file within dir.
+// Not every platform supports syncing a directory, so this is best-effort.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
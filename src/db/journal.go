@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"attendance.com/src/logger"
+)
+
+// journalFile is the name of the append-only journal kept alongside the JSON documents
+const journalFile = "journal.log"
+
+// Operations recorded in the journal
+const (
+	opPutUser       = "putUser"
+	opPutAttendance = "putAttendance"
+)
+
+// journalEntry is a single line of the journal
+type journalEntry struct {
+	Op         string
+	User       *User            `json:",omitempty"`
+	Attendance *attendanceEntry `json:",omitempty"`
+}
+
+// attendanceEntry is the journaled form of an attendance record
+type attendanceEntry struct {
+	Date   time.Time
+	UserID string
+	Record Attendance
+}
+
+// journal is an append-only log of writes.
+// Entries are synced to disk before the corresponding document is rewritten,
+// so a crash mid-write loses at most the entry being appended. It is emptied once the documents hold its entries.
+// It is not safe for concurrent use, callers serialize access.
+type journal struct {
+	path string
+}
+
+func newJournal(filePath string) *journal {
+	return &journal{path: os.Getenv("APP_DB_PATH") + filePath}
+}
+
+// append writes the entries to the end of the journal and syncs the file.
+func (j *journal) append(entries ...journalEntry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("encoding journal entry: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("appending to journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+
+	return nil
+}
+
+// replay calls apply for every entry in the journal, in the order they were written.
+// A torn last line, left behind by a crash during append, is logged and skipped.
+func (j *journal) replay(apply func(journalEntry)) (int, error) {
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening journal: %w", err)
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Println(fmt.Sprint("skipping unreadable journal entry:", err))
+			continue
+		}
+		apply(entry)
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+// truncate empties the journal once its entries are reflected in the documents.
+func (j *journal) truncate() error {
+	err := os.Truncate(j.path, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,407 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"attendance.com/src/logger"
+)
+
+// File names of the collections maintained by the JSON driver
+const (
+	usersFile       = "users.json"
+	sessionsFile    = "sessions.json"
+	attendanceFile  = "attendance.json"
+	schedulesFile   = "schedules.json"
+	locationsFile   = "locations.json"
+	coursesFile     = "courses.json"
+	enrollmentsFile = "enrollments.json"
+	auditFile       = "audit.json"
+)
+
+// jsonStore is the Store driver that keeps every collection in a JSON document.
+// It holds a copy of each collection in memory so that a write only needs to re-encode the affected document.
+// User changes and check-ins are appended to a journal before their document is rewritten,
+// the journal being the point at which such a write is considered committed.
+// The journal is emptied whenever every journaled document has been rewritten, so it only holds the writes that have not reached their document.
+type jsonStore struct {
+	mu      sync.Mutex
+	journal *journal
+	// unwritten holds the journaled documents whose last rewrite failed, whose changes only the journal holds
+	unwritten   map[string]bool
+	users       map[string]User
+	sessions    map[string]Session
+	attendance  map[time.Time]map[string]Attendance
+	schedules   map[string]Schedule
+	locations   map[string]Location
+	courses     map[string]Course
+	enrollments map[string]map[string]Enrollment
+	audit       []AuditEntry
+}
+
+func openJSONStore() (*jsonStore, error) {
+	s := &jsonStore{
+		journal:     newJournal(journalFile),
+		unwritten:   map[string]bool{},
+		users:       map[string]User{},
+		sessions:    map[string]Session{},
+		attendance:  map[time.Time]map[string]Attendance{},
+		schedules:   map[string]Schedule{},
+		locations:   map[string]Location{},
+		courses:     map[string]Course{},
+		enrollments: map[string]map[string]Enrollment{},
+	}
+
+	if err := readOptional(usersFile, &s.users); err != nil {
+		return nil, err
+	}
+	if err := readOptional(sessionsFile, &s.sessions); err != nil {
+		return nil, err
+	}
+	if err := readOptional(attendanceFile, &s.attendance); err != nil {
+		return nil, err
+	}
+	if err := readOptional(schedulesFile, &s.schedules); err != nil {
+		return nil, err
+	}
+	if err := readOptional(locationsFile, &s.locations); err != nil {
+		return nil, err
+	}
+	if err := readOptional(coursesFile, &s.courses); err != nil {
+		return nil, err
+	}
+	if err := readOptional(enrollmentsFile, &s.enrollments); err != nil {
+		return nil, err
+	}
+	if err := readOptional(auditFile, &s.audit); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// readOptional reads a JSON document, treating a missing or empty file as an empty collection.
+func readOptional(filePath string, payload interface{}) error {
+	err := Read(filePath, payload)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrEmptyDocument) {
+		return nil
+	}
+	return err
+}
+
+func (s *jsonStore) LoadUsers() (map[string]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]User, len(s.users))
+	for k, v := range s.users {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutUsers(users ...User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]journalEntry, len(users))
+	for i := range users {
+		entries[i] = journalEntry{Op: opPutUser, User: &users[i]}
+	}
+	if err := s.journal.append(entries...); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		s.users[user.ID] = user
+	}
+	s.writeCommitted(s.users, usersFile)
+	return nil
+}
+
+func (s *jsonStore) LoadSessions() (map[string]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]Session, len(s.sessions))
+	for k, v := range s.sessions {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutSession(sessionID string, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[sessionID] = session
+	return Write(s.sessions, sessionsFile)
+}
+
+func (s *jsonStore) DeleteSessions(sessionIDs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := false
+	for _, sessionID := range sessionIDs {
+		if _, ok := s.sessions[sessionID]; ok {
+			delete(s.sessions, sessionID)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return Write(s.sessions, sessionsFile)
+}
+
+func (s *jsonStore) LoadAttendance() (map[time.Time]map[string]Attendance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[time.Time]map[string]Attendance, len(s.attendance))
+	for date, users := range s.attendance {
+		result[date] = make(map[string]Attendance, len(users))
+		for id, record := range users {
+			result[date][id] = record
+		}
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutAttendance(date time.Time, userID string, record Attendance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := journalEntry{Op: opPutAttendance, Attendance: &attendanceEntry{Date: date, UserID: userID, Record: record}}
+	if err := s.journal.append(entry); err != nil {
+		return err
+	}
+
+	s.applyAttendance(*entry.Attendance)
+	s.writeCommitted(s.attendance, attendanceFile)
+	return nil
+}
+
+func (s *jsonStore) applyAttendance(entry attendanceEntry) {
+	if _, ok := s.attendance[entry.Date]; !ok {
+		s.attendance[entry.Date] = make(map[string]Attendance)
+	}
+	s.attendance[entry.Date][entry.UserID] = entry.Record
+}
+
+func (s *jsonStore) LoadSchedules() (map[string]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]Schedule, len(s.schedules))
+	for k, v := range s.schedules {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutSchedule(schedule Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[schedule.ID] = schedule
+	return Write(s.schedules, schedulesFile)
+}
+
+func (s *jsonStore) DeleteSchedule(scheduleID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[scheduleID]; !ok {
+		return nil
+	}
+	delete(s.schedules, scheduleID)
+	return Write(s.schedules, schedulesFile)
+}
+
+func (s *jsonStore) LoadLocations() (map[string]Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]Location, len(s.locations))
+	for k, v := range s.locations {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutLocation(location Location) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.locations[location.ID] = location
+	return Write(s.locations, locationsFile)
+}
+
+func (s *jsonStore) DeleteLocation(locationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.locations[locationID]; !ok {
+		return nil
+	}
+	delete(s.locations, locationID)
+	return Write(s.locations, locationsFile)
+}
+
+func (s *jsonStore) LoadCourses() (map[string]Course, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]Course, len(s.courses))
+	for k, v := range s.courses {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutCourse(course Course) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.courses[course.ID] = course
+	return Write(s.courses, coursesFile)
+}
+
+func (s *jsonStore) DeleteCourse(courseID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.enrollments[courseID]; ok {
+		delete(s.enrollments, courseID)
+		if err := Write(s.enrollments, enrollmentsFile); err != nil {
+			return err
+		}
+	}
+	if _, ok := s.courses[courseID]; !ok {
+		return nil
+	}
+	delete(s.courses, courseID)
+	return Write(s.courses, coursesFile)
+}
+
+func (s *jsonStore) LoadEnrollments() (map[string]map[string]Enrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]map[string]Enrollment, len(s.enrollments))
+	for courseID, users := range s.enrollments {
+		result[courseID] = make(map[string]Enrollment, len(users))
+		for userID, enrollment := range users {
+			result[courseID][userID] = enrollment
+		}
+	}
+	return result, nil
+}
+
+func (s *jsonStore) PutEnrollments(enrollments ...Enrollment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, enrollment := range enrollments {
+		if _, ok := s.enrollments[enrollment.CourseID]; !ok {
+			s.enrollments[enrollment.CourseID] = map[string]Enrollment{}
+		}
+		s.enrollments[enrollment.CourseID][enrollment.UserID] = enrollment
+	}
+	return Write(s.enrollments, enrollmentsFile)
+}
+
+func (s *jsonStore) DeleteEnrollments(courseID string, userIDs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := false
+	for _, userID := range userIDs {
+		if _, ok := s.enrollments[courseID][userID]; ok {
+			delete(s.enrollments[courseID], userID)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return Write(s.enrollments, enrollmentsFile)
+}
+
+// writeCommitted rewrites a document after its change has been journaled.
+// A failure is only logged since the change is recovered from the journal by the next Replay.
+// Once no journaled document is left unwritten, every journaled change has reached its document and the journal is emptied,
+// so that it neither grows without bound nor keeps a second copy of the users.
+func (s *jsonStore) writeCommitted(payload interface{}, filePath string) {
+	if err := Write(payload, filePath); err != nil {
+		logger.Println(err)
+		s.unwritten[filePath] = true
+		return
+	}
+	delete(s.unwritten, filePath)
+
+	if len(s.unwritten) == 0 {
+		if err := s.journal.truncate(); err != nil {
+			logger.Println(err)
+		}
+	}
+}
+
+// LoadAuditEntries returns a copy of the audit log, oldest entry first.
+func (s *jsonStore) LoadAuditEntries() ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]AuditEntry{}, s.audit...), nil
+}
+
+// AppendAuditEntry appends an entry to the audit log and rewrites its document.
+func (s *jsonStore) AppendAuditEntry(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = append(s.audit, entry)
+	return Write(s.audit, auditFile)
+}
+
+// Replay applies every journaled entry on top of the loaded documents, rewrites them and empties the journal.
+// Entries are idempotent upserts, so replaying changes that already reached their document is harmless.
+func (s *jsonStore) Replay() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, err := s.journal.replay(func(entry journalEntry) {
+		switch {
+		case entry.Op == opPutUser && entry.User != nil:
+			s.users[entry.User.ID] = *entry.User
+		case entry.Op == opPutAttendance && entry.Attendance != nil:
+			s.applyAttendance(*entry.Attendance)
+		default:
+			logger.Println("skipping unknown journal entry::" + entry.Op)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	logger.Println(fmt.Sprintf("Replayed %d journal entries", count))
+
+	if err := Write(s.users, usersFile); err != nil {
+		return err
+	}
+	if err := Write(s.attendance, attendanceFile); err != nil {
+		return err
+	}
+	return s.journal.truncate()
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
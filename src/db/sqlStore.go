@@ -0,0 +1,503 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	// registers the pure-Go "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// sqlMigrations holds the schema changes of the sqlite driver, applied in order.
+// The number of applied migrations is tracked through PRAGMA user_version, so new migrations must only ever be appended.
+var sqlMigrations = []string{
+	`CREATE TABLE users (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE sessions (
+		id      TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL
+	);
+	CREATE TABLE attendance (
+		date     TEXT NOT NULL,
+		user_id  TEXT NOT NULL,
+		check_in TEXT NOT NULL,
+		PRIMARY KEY (date, user_id)
+	);`,
+	`ALTER TABLE sessions ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN last_seen TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE attendance ADD COLUMN data TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE schedules (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE TABLE locations (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`CREATE TABLE courses (
+		id   TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE enrollments (
+		course_id TEXT NOT NULL,
+		user_id   TEXT NOT NULL,
+		data      TEXT NOT NULL,
+		PRIMARY KEY (course_id, user_id)
+	);`,
+	`ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE audit (
+		id   INTEGER PRIMARY KEY AUTOINCREMENT,
+		data TEXT NOT NULL
+	);`,
+}
+
+// sqlStore is the Store driver backed by an embedded SQLite database.
+// Apart from sessions, records are stored as JSON documents so that new fields do not require a schema change.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func openSQLStore(dsn string) (*sqlStore, error) {
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	// SQLite allows a single writer, serialize access instead of handling busy errors
+	conn.SetMaxOpenConns(1)
+
+	if _, err := conn.Exec("PRAGMA journal_mode = WAL; PRAGMA foreign_keys = ON;"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("configuring sqlite database: %w", err)
+	}
+
+	s := &sqlStore{db: conn}
+	if err := s.migrate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrate applies all migrations that have not yet been applied to the database.
+func (s *sqlStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("updating schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) LoadUsers() (map[string]User, error) {
+	rows, err := s.db.Query("SELECT id, data FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string]User{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var user User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, fmt.Errorf("decoding user %s: %w", id, err)
+		}
+		users[id] = user
+	}
+
+	return users, rows.Err()
+}
+
+func (s *sqlStore) PutUsers(users ...User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO users (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, user := range users {
+		data, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("encoding user %s: %w", user.ID, err)
+		}
+		if _, err := stmt.Exec(user.ID, string(data)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) LoadSessions() (map[string]Session, error) {
+	rows, err := s.db.Query("SELECT id, user_id, created_at, last_seen, csrf_token FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := map[string]Session{}
+	for rows.Next() {
+		var id, userID, createdAt, lastSeen, csrfToken string
+		if err := rows.Scan(&id, &userID, &createdAt, &lastSeen, &csrfToken); err != nil {
+			return nil, err
+		}
+		session := Session{UserID: userID, CSRFToken: csrfToken}
+		// Sessions created before timestamps were tracked keep zero times
+		session.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		session.LastSeen, _ = time.Parse(time.RFC3339Nano, lastSeen)
+		sessions[id] = session
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) PutSession(sessionID string, session Session) error {
+	_, err := s.db.Exec(
+		`INSERT INTO sessions (id, user_id, created_at, last_seen, csrf_token) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, created_at = excluded.created_at, last_seen = excluded.last_seen,
+		csrf_token = excluded.csrf_token`,
+		sessionID, session.UserID, session.CreatedAt.Format(time.RFC3339Nano), session.LastSeen.Format(time.RFC3339Nano), session.CSRFToken,
+	)
+	return err
+}
+
+func (s *sqlStore) DeleteSessions(sessionIDs ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, sessionID := range sessionIDs {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE id = ?", sessionID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) LoadAttendance() (map[time.Time]map[string]Attendance, error) {
+	rows, err := s.db.Query("SELECT date, user_id, check_in, data FROM attendance")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attendance := map[time.Time]map[string]Attendance{}
+	for rows.Next() {
+		var date, userID, checkIn, data string
+		if err := rows.Scan(&date, &userID, &checkIn, &data); err != nil {
+			return nil, err
+		}
+		// Parsing RFC3339 yields the Local location when the offset matches,
+		// keeping the keys comparable with the dates built by the services
+		dateTime, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, err
+		}
+
+		var record Attendance
+		if data != "" {
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				return nil, fmt.Errorf("decoding attendance of %s on %s: %w", userID, date, err)
+			}
+		} else if record.CheckIn, err = time.Parse(time.RFC3339Nano, checkIn); err != nil {
+			// rows written before records were stored as JSON only hold the check-in time
+			return nil, err
+		}
+
+		if _, ok := attendance[dateTime]; !ok {
+			attendance[dateTime] = map[string]Attendance{}
+		}
+		attendance[dateTime][userID] = record
+	}
+
+	return attendance, rows.Err()
+}
+
+func (s *sqlStore) PutAttendance(date time.Time, userID string, record Attendance) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding attendance of %s: %w", userID, err)
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO attendance (date, user_id, check_in, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (date, user_id) DO UPDATE SET check_in = excluded.check_in, data = excluded.data`,
+		date.Format(time.RFC3339), userID, record.CheckIn.Format(time.RFC3339Nano), string(data),
+	)
+	return err
+}
+
+func (s *sqlStore) LoadSchedules() (map[string]Schedule, error) {
+	rows, err := s.db.Query("SELECT id, data FROM schedules")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := map[string]Schedule{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var schedule Schedule
+		if err := json.Unmarshal([]byte(data), &schedule); err != nil {
+			return nil, fmt.Errorf("decoding schedule %s: %w", id, err)
+		}
+		schedules[id] = schedule
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *sqlStore) PutSchedule(schedule Schedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("encoding schedule %s: %w", schedule.ID, err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO schedules (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data", schedule.ID, string(data))
+	return err
+}
+
+func (s *sqlStore) DeleteSchedule(scheduleID string) error {
+	_, err := s.db.Exec("DELETE FROM schedules WHERE id = ?", scheduleID)
+	return err
+}
+
+func (s *sqlStore) LoadLocations() (map[string]Location, error) {
+	rows, err := s.db.Query("SELECT id, data FROM locations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := map[string]Location{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var location Location
+		if err := json.Unmarshal([]byte(data), &location); err != nil {
+			return nil, fmt.Errorf("decoding location %s: %w", id, err)
+		}
+		locations[id] = location
+	}
+
+	return locations, rows.Err()
+}
+
+func (s *sqlStore) PutLocation(location Location) error {
+	data, err := json.Marshal(location)
+	if err != nil {
+		return fmt.Errorf("encoding location %s: %w", location.ID, err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO locations (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data", location.ID, string(data))
+	return err
+}
+
+func (s *sqlStore) DeleteLocation(locationID string) error {
+	_, err := s.db.Exec("DELETE FROM locations WHERE id = ?", locationID)
+	return err
+}
+
+func (s *sqlStore) LoadCourses() (map[string]Course, error) {
+	rows, err := s.db.Query("SELECT id, data FROM courses")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	courses := map[string]Course{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var course Course
+		if err := json.Unmarshal([]byte(data), &course); err != nil {
+			return nil, fmt.Errorf("decoding course %s: %w", id, err)
+		}
+		courses[id] = course
+	}
+
+	return courses, rows.Err()
+}
+
+func (s *sqlStore) PutCourse(course Course) error {
+	data, err := json.Marshal(course)
+	if err != nil {
+		return fmt.Errorf("encoding course %s: %w", course.ID, err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO courses (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data", course.ID, string(data))
+	return err
+}
+
+func (s *sqlStore) DeleteCourse(courseID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM enrollments WHERE course_id = ?", courseID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM courses WHERE id = ?", courseID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) LoadEnrollments() (map[string]map[string]Enrollment, error) {
+	rows, err := s.db.Query("SELECT course_id, user_id, data FROM enrollments")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	enrollments := map[string]map[string]Enrollment{}
+	for rows.Next() {
+		var courseID, userID, data string
+		if err := rows.Scan(&courseID, &userID, &data); err != nil {
+			return nil, err
+		}
+		var enrollment Enrollment
+		if err := json.Unmarshal([]byte(data), &enrollment); err != nil {
+			return nil, fmt.Errorf("decoding enrollment of %s in %s: %w", userID, courseID, err)
+		}
+		if _, ok := enrollments[courseID]; !ok {
+			enrollments[courseID] = map[string]Enrollment{}
+		}
+		enrollments[courseID][userID] = enrollment
+	}
+
+	return enrollments, rows.Err()
+}
+
+func (s *sqlStore) PutEnrollments(enrollments ...Enrollment) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO enrollments (course_id, user_id, data) VALUES (?, ?, ?) ON CONFLICT (course_id, user_id) DO UPDATE SET data = excluded.data")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, enrollment := range enrollments {
+		data, err := json.Marshal(enrollment)
+		if err != nil {
+			return fmt.Errorf("encoding enrollment of %s in %s: %w", enrollment.UserID, enrollment.CourseID, err)
+		}
+		if _, err := stmt.Exec(enrollment.CourseID, enrollment.UserID, string(data)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteEnrollments(courseID string, userIDs ...string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, userID := range userIDs {
+		if _, err := tx.Exec("DELETE FROM enrollments WHERE course_id = ? AND user_id = ?", courseID, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// LoadAuditEntries returns every row of the audit table, oldest entry first.
+func (s *sqlStore) LoadAuditEntries() ([]AuditEntry, error) {
+	rows, err := s.db.Query("SELECT id, data FROM audit ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("decoding audit entry %d: %w", id, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// AppendAuditEntry inserts an entry into the audit table.
+func (s *sqlStore) AppendAuditEntry(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %w", err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO audit (data) VALUES (?)", string(data))
+	return err
+}
+
+// Replay is a no-op, SQLite recovers its own write-ahead log when the database is opened.
+func (s *sqlStore) Replay() error {
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Drivers supported by Open
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Roles a user can be assigned
+const (
+	RoleStudent    = "student"
+	RoleInstructor = "instructor"
+	RoleAdmin      = "admin"
+	RoleAuditor    = "auditor"
+)
+
+// User struct represents the persisted metadata of a user
+// Role is empty for users persisted before roles were introduced.
+// Email and EnrollmentCode come from the student list, EnrollmentCode holding the SHA-256 of the one-time code registration must prove.
+// TOTPSecret is set once the user enrolled in two-factor authentication, TOTPLastStep being the time step of the last code used
+// and RecoveryCodes the SHA-256 of the unused recovery codes.
+type User struct {
+	ID             string
+	Password       []byte
+	First          string
+	Last           string
+	Role           string
+	Email          string   `json:",omitempty"`
+	EnrollmentCode string   `json:",omitempty"`
+	TOTPSecret     string   `json:",omitempty"`
+	TOTPLastStep   int64    `json:",omitempty"`
+	RecoveryCodes  []string `json:",omitempty"`
+	Deactivated    bool     `json:",omitempty"`
+	Cohort         string   `json:",omitempty"`
+	Tags           []string `json:",omitempty"`
+}
+
+// Session struct represents a persisted login session
+// CSRFToken is the token the forms submitted within the session must hold.
+type Session struct {
+	UserID    string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	CSRFToken string
+}
+
+// UnmarshalJSON decodes a session, accepting the legacy format where a session only held the user ID.
+// Legacy sessions have no timestamps and are therefore treated as expired.
+func (s *Session) UnmarshalJSON(data []byte) error {
+	var userID string
+	if err := json.Unmarshal(data, &userID); err == nil {
+		*s = Session{UserID: userID}
+		return nil
+	}
+
+	// alias drops the UnmarshalJSON method to avoid recursing
+	type alias Session
+	return json.Unmarshal(data, (*alias)(s))
+}
+
+// Attendance statuses assigned at check-in
+const (
+	StatusOnTime         = "on-time"
+	StatusLate           = "late"
+	StatusOutsideSession = "outside-session"
+)
+
+// Attendance struct represents the persisted attendance of a user on a given date
+// CheckOut is the zero time until the user checks out.
+// Status classifies the check-in against the scheduled class sessions, ScheduleID being the session it matched.
+// LocationID is the location whose networks the check-in came from, empty if no locations are defined.
+// CourseID is the course the user checked in for, empty if the user is not enrolled in any course.
+type Attendance struct {
+	CheckIn    time.Time
+	CheckOut   time.Time
+	Status     string
+	ScheduleID string
+	LocationID string
+	CourseID   string
+}
+
+// UnmarshalJSON decodes an attendance record, accepting the legacy format where a record only held the check-in time.
+func (a *Attendance) UnmarshalJSON(data []byte) error {
+	var checkIn time.Time
+	if err := json.Unmarshal(data, &checkIn); err == nil {
+		*a = Attendance{CheckIn: checkIn}
+		return nil
+	}
+
+	// alias drops the UnmarshalJSON method to avoid recursing
+	type alias Attendance
+	return json.Unmarshal(data, (*alias)(a))
+}
+
+// IsCheckedOut reports whether the user has checked out.
+func (a Attendance) IsCheckedOut() bool {
+	return !a.CheckOut.IsZero()
+}
+
+// Duration returns the time spent on site, or zero if the user has not checked out.
+func (a Attendance) Duration() time.Duration {
+	if !a.IsCheckedOut() {
+		return 0
+	}
+	return a.CheckOut.Sub(a.CheckIn)
+}
+
+// Schedule struct represents a scheduled class session
+// StartTime and EndTime are "15:04" times of day, StartDate the "2006-01-02" date of the first occurrence.
+// Recurrence is a subset of the iCalendar RRULE syntax, e.g. "FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=2024-03-01".
+// An empty Recurrence means the session only occurs on StartDate.
+// Course is the label of the course, and CourseID the course the session belongs to, empty for schedules created before courses existed.
+type Schedule struct {
+	ID           string
+	CourseID     string
+	Course       string
+	StartDate    string
+	StartTime    string
+	EndTime      string
+	GraceMinutes int
+	Recurrence   string
+}
+
+// Location struct represents a campus or site that check-ins are accepted from
+// Networks are the CIDR ranges of the site, and Timezone an IANA time zone name such as "Asia/Singapore".
+type Location struct {
+	ID       string
+	Name     string
+	Networks []string
+	Timezone string
+}
+
+// Course struct represents a class that students are enrolled in
+// InstructorIDs are the IDs of the instructors who own the course and can view its attendance.
+type Course struct {
+	ID            string
+	Code          string
+	Name          string
+	InstructorIDs []string
+}
+
+// AuditEntry struct represents a security-relevant event, such as an account being locked out
+// Actor is the ID of the user who caused the event, empty for events raised by the system,
+// and Subject what the event applies to, such as a user ID or a client address.
+type AuditEntry struct {
+	Time    time.Time
+	Actor   string
+	Action  string
+	Subject string
+	Detail  string
+}
+
+// Enrollment struct represents a user enrolled in a course
+type Enrollment struct {
+	CourseID   string
+	UserID     string
+	EnrolledAt time.Time
+}
+
+// Store is the persistence interface used by the states package.
+// Every write method persists only the records it is given, so drivers are free to avoid rewriting whole collections.
+type Store interface {
+	// LoadUsers returns all persisted users keyed by user ID.
+	LoadUsers() (map[string]User, error)
+	// PutUsers inserts or replaces the given users.
+	PutUsers(users ...User) error
+
+	// LoadSessions returns all persisted sessions keyed by session ID.
+	LoadSessions() (map[string]Session, error)
+	// PutSession inserts or replaces a session.
+	PutSession(sessionID string, session Session) error
+	// DeleteSessions removes the given sessions. Deleting an unknown session is not an error.
+	DeleteSessions(sessionIDs ...string) error
+
+	// LoadAttendance returns all persisted attendance as a map of dates to a map of user IDs to attendance records.
+	LoadAttendance() (map[time.Time]map[string]Attendance, error)
+	// PutAttendance inserts or replaces the attendance record of a user on the given date.
+	PutAttendance(date time.Time, userID string, record Attendance) error
+
+	// LoadSchedules returns all persisted class schedules keyed by schedule ID.
+	LoadSchedules() (map[string]Schedule, error)
+	// PutSchedule inserts or replaces a class schedule.
+	PutSchedule(schedule Schedule) error
+	// DeleteSchedule removes a class schedule. Deleting an unknown schedule is not an error.
+	DeleteSchedule(scheduleID string) error
+
+	// LoadLocations returns all persisted locations keyed by location ID.
+	LoadLocations() (map[string]Location, error)
+	// PutLocation inserts or replaces a location.
+	PutLocation(location Location) error
+	// DeleteLocation removes a location. Deleting an unknown location is not an error.
+	DeleteLocation(locationID string) error
+
+	// LoadCourses returns all persisted courses keyed by course ID.
+	LoadCourses() (map[string]Course, error)
+	// PutCourse inserts or replaces a course.
+	PutCourse(course Course) error
+	// DeleteCourse removes a course along with its enrollments. Deleting an unknown course is not an error.
+	DeleteCourse(courseID string) error
+
+	// LoadEnrollments returns all persisted enrollments as a map of course IDs to a map of user IDs to enrollments.
+	LoadEnrollments() (map[string]map[string]Enrollment, error)
+	// PutEnrollments inserts or replaces the given enrollments.
+	PutEnrollments(enrollments ...Enrollment) error
+	// DeleteEnrollments removes the enrollments of the given users in a course. Deleting an unknown enrollment is not an error.
+	DeleteEnrollments(courseID string, userIDs ...string) error
+
+	// LoadAuditEntries returns all persisted audit entries, oldest first.
+	LoadAuditEntries() ([]AuditEntry, error)
+	// AppendAuditEntry persists a new audit entry.
+	AppendAuditEntry(entry AuditEntry) error
+
+	// Replay re-applies writes that were recorded but may not have reached the underlying storage before a crash.
+	// It must be called once at startup, before any collection is loaded.
+	Replay() error
+
+	// Close releases any resources held by the driver.
+	Close() error
+}
+
+// Open returns the Store for the given driver.
+// An empty driver defaults to the JSON driver.
+// The dsn is only used by the sqlite driver and defaults to attendance.db within APP_DB_PATH.
+func Open(driver, dsn string) (Store, error) {
+	switch driver {
+	case "", DriverJSON:
+		return openJSONStore()
+	case DriverSQLite:
+		if dsn == "" {
+			dsn = os.Getenv("APP_DB_PATH") + "attendance.db"
+		}
+		return openSQLStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown db driver %q", driver)
+	}
+}
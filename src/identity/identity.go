@@ -0,0 +1,22 @@
+/*
+Package identity authenticates users against external identity providers, such as the central accounts of an institution.
+
+The identity package resolves the identity of a user at the provider, whose ID the services then map onto a roster ID:
+
+  - LDAP: checks a username and password by binding to a directory as the user.
+  - OIDC: signs users in through the authorization code flow of an OpenID Connect provider.
+*/
+package identity
+
+import "errors"
+
+// ErrInvalidCredentials is returned when the provider does not recognize the username and password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity struct represents a user authenticated by an external provider
+// Subject is the identifier of the user at the provider,
+// and ID the value of the claim or attribute that is mapped onto roster IDs.
+type Identity struct {
+	Subject string
+	ID      string
+}
@@ -0,0 +1,188 @@
+package identitytest
+
+import (
+	"net"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// LDAP protocol operations answered by the stub directory
+const (
+	ldapBindRequest    ber.Tag = 0
+	ldapBindResponse   ber.Tag = 1
+	ldapSearchRequest  ber.Tag = 3
+	ldapSearchEntry    ber.Tag = 4
+	ldapSearchDone     ber.Tag = 5
+	ldapEqualityFilter ber.Tag = 3
+)
+
+// LDAP result codes returned by the stub directory
+const (
+	ldapSuccess                  = 0
+	ldapInvalidCredentials       = 49
+	ldapInsufficientAccessRights = 50
+	ldapUnwillingToPerform       = 53
+)
+
+// Entry struct represents an entry of the stub directory, which users bind as with its password
+type Entry struct {
+	Password   string
+	Attributes map[string]string
+}
+
+// Directory struct represents a stub LDAP directory, reached at URL
+// Entries maps the DNs of the directory to their entry. If BindDN is set, searches are only answered once bound as it with BindPassword,
+// and anonymously otherwise.
+type Directory struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	Entries      map[string]Entry
+
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewDirectory starts a stub directory holding the entries. Callers should Close it when done.
+func NewDirectory(bindDN string, bindPassword string, entries map[string]Entry) *Directory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("identitytest: listening: " + err.Error())
+	}
+
+	d := &Directory{
+		URL:          "ldap://" + listener.Addr().String(),
+		BindDN:       bindDN,
+		BindPassword: bindPassword,
+		Entries:      entries,
+		listener:     listener,
+	}
+	d.wg.Add(1)
+	go d.accept()
+	return d
+}
+
+// Close stops the directory from accepting connections.
+func (d *Directory) Close() {
+	d.listener.Close()
+	d.wg.Wait()
+}
+
+// accept serves the connections to the directory until it is closed.
+func (d *Directory) accept() {
+	defer d.wg.Done()
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.serve(conn)
+	}
+}
+
+// serve answers the binds and searches of a connection, until it unbinds or sends a request the stub does not understand.
+func (d *Directory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldapBindRequest:
+			if len(request.Children) < 3 {
+				return
+			}
+			name, _ := request.Children[1].Value.(string)
+			code := d.bind(name, request.Children[2].Data.String())
+			if code == ldapSuccess {
+				bound = name
+			}
+			reply(conn, messageID, result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			if len(request.Children) < 8 {
+				return
+			}
+			if d.BindDN != "" && bound != d.BindDN {
+				reply(conn, messageID, result(ldapSearchDone, ldapInsufficientAccessRights))
+				continue
+			}
+			filter := request.Children[6]
+			if filter.ClassType != ber.ClassContext || filter.Tag != ldapEqualityFilter || len(filter.Children) != 2 {
+				reply(conn, messageID, result(ldapSearchDone, ldapUnwillingToPerform))
+				continue
+			}
+			attribute, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+			requested := []string{}
+			for _, child := range request.Children[7].Children {
+				requested = append(requested, child.Data.String())
+			}
+			for dn, entry := range d.Entries {
+				if entry.Attributes[attribute] == value {
+					reply(conn, messageID, searchEntry(dn, entry, requested))
+				}
+			}
+			reply(conn, messageID, result(ldapSearchDone, ldapSuccess))
+		default:
+			return
+		}
+	}
+}
+
+// bind returns the result code of binding as the DN with the password.
+func (d *Directory) bind(dn string, password string) int64 {
+	if d.BindDN != "" && dn == d.BindDN && password == d.BindPassword {
+		return ldapSuccess
+	}
+	if entry, ok := d.Entries[dn]; ok && password != "" && entry.Password == password {
+		return ldapSuccess
+	}
+	return ldapInvalidCredentials
+}
+
+// reply writes the response of a protocol operation to the request with the message ID.
+func reply(conn net.Conn, messageID int64, response *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	packet.AppendChild(response)
+	conn.Write(packet.Bytes())
+}
+
+// result returns the response of a protocol operation with the result code, and no matched DN or diagnostic message.
+func result(tag ber.Tag, code int64) *ber.Packet {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return response
+}
+
+// searchEntry returns a search result entry holding the requested attributes of the entry.
+func searchEntry(dn string, entry Entry, requested []string) *ber.Packet {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchEntry, nil, "Search Result Entry")
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range requested {
+		value, ok := entry.Attributes[name]
+		if !ok {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	response.AppendChild(attributes)
+	return response
+}
@@ -0,0 +1,153 @@
+/*
+Package identitytest provides stub identity providers for testing the identity package and the services that use it.
+
+The identitytest package includes two stubs listening on the loopback interface:
+
+  - Provider: an OpenID Connect provider serving discovery, its signing keys and a token endpoint that redeems the codes issued by Authorize.
+  - Directory: an LDAP directory answering simple binds and equality searches over its entries.
+*/
+package identitytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// providerKeyID is the key ID of the signing key of the stub provider
+const providerKeyID = "stub"
+
+// Provider struct represents a stub OpenID Connect provider
+// ClientID is the client the provider issues ID tokens to, as their audience.
+type Provider struct {
+	*httptest.Server
+	ClientID string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]map[string]interface{}
+}
+
+// NewProvider starts a stub provider issuing ID tokens to the client. Callers should Close it when done.
+func NewProvider(clientID string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("identitytest: generating key: " + err.Error())
+	}
+
+	p := &Provider{ClientID: clientID, key: key, codes: map[string]map[string]interface{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Authorize returns an authorization code that the token endpoint redeems once for an ID token holding the claims,
+// as if a user had signed in. The issuer, audience, subject, issue and expiry claims default to those of a valid token.
+func (p *Provider) Authorize(claims map[string]interface{}) string {
+	now := time.Now()
+	token := map[string]interface{}{
+		"iss": p.URL,
+		"aud": p.ClientID,
+		"sub": "subject",
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range claims {
+		token[name] = value
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(p.codes)+1)
+	p.codes[code] = token
+	return code
+}
+
+// discovery serves the provider metadata.
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// jwks serves the public signing key of the provider.
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": providerKeyID,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems an authorization code issued by Authorize for a signed ID token.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	p.mu.Lock()
+	claims, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns the claims as a JWT signed with RS256 by the key of the provider.
+func (p *Provider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": providerKeyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// writeJSON writes the payload as a JSON response with the status code.
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,73 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout bounds the time taken by each request to the directory
+const ldapTimeout = 10 * time.Second
+
+// LDAP struct represents a directory that users authenticate against
+// The entry of a user is searched under BaseDN with UserFilter, whose %s is replaced by the escaped username,
+// binding as BindDN first if it is set and anonymously otherwise. The user is then authenticated by binding as their entry,
+// and IDAttribute is the attribute of the entry that is mapped onto roster IDs.
+type LDAP struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	IDAttribute  string
+}
+
+// Authenticate checks the username and password against the directory and returns the identity of the user.
+// It returns ErrInvalidCredentials if the username is unknown or the password does not match.
+func (d *LDAP) Authenticate(username string, password string) (Identity, error) {
+	if username == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(d.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return Identity{}, fmt.Errorf("connecting to %s: %w", d.URL, err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if d.BindDN != "" {
+		if err := conn.Bind(d.BindDN, d.BindPassword); err != nil {
+			return Identity{}, fmt.Errorf("binding as %s: %w", d.BindDN, err)
+		}
+	}
+
+	search := ldap.NewSearchRequest(d.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		strings.ReplaceAll(d.UserFilter, "%s", ldap.EscapeFilter(username)), []string{d.IDAttribute}, nil)
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return Identity{}, fmt.Errorf("searching for %s: %w", username, err)
+	}
+	// unknown usernames, and filters matching several entries, are refused alike
+	if result == nil || len(result.Entries) != 1 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{}, fmt.Errorf("binding as %s: %w", entry.DN, err)
+	}
+
+	id := entry.GetAttributeValue(d.IDAttribute)
+	if id == "" {
+		return Identity{}, errors.New(entry.DN + " has no " + d.IDAttribute + " attribute")
+	}
+	return Identity{Subject: entry.DN, ID: id}, nil
+}
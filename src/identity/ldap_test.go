@@ -0,0 +1,88 @@
+package identity_test
+
+import (
+	"errors"
+	"testing"
+
+	"attendance.com/src/identity"
+	"attendance.com/src/identity/identitytest"
+)
+
+func newTestDirectory(t *testing.T) *identity.LDAP {
+	t.Helper()
+	directory := identitytest.NewDirectory("cn=svc,dc=example,dc=org", "svc-secret", map[string]identitytest.Entry{
+		"uid=jdoe,ou=people,dc=example,dc=org": {
+			Password:   "jdoe-secret",
+			Attributes: map[string]string{"uid": "jdoe", "employeeNumber": "s123456"},
+		},
+		"uid=nonum,ou=people,dc=example,dc=org": {
+			Password:   "nonum-secret",
+			Attributes: map[string]string{"uid": "nonum"},
+		},
+	})
+	t.Cleanup(directory.Close)
+
+	return &identity.LDAP{
+		URL:          directory.URL,
+		BindDN:       directory.BindDN,
+		BindPassword: directory.BindPassword,
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(uid=%s)",
+		IDAttribute:  "employeeNumber",
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	directory := newTestDirectory(t)
+
+	id, err := directory.Authenticate("jdoe", "jdoe-secret")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	want := identity.Identity{Subject: "uid=jdoe,ou=people,dc=example,dc=org", ID: "s123456"}
+	if id != want {
+		t.Errorf("Authenticate() = %+v, want %+v", id, want)
+	}
+}
+
+func TestLDAPAuthenticateInvalidCredentials(t *testing.T) {
+	directory := newTestDirectory(t)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "jdoe", "wrong"},
+		{"unknown username", "nobody", "jdoe-secret"},
+		{"empty password", "jdoe", ""},
+		{"empty username", "", "jdoe-secret"},
+		{"filter injection", "*", "jdoe-secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := directory.Authenticate(tt.username, tt.password); !errors.Is(err, identity.ErrInvalidCredentials) {
+				t.Errorf("Authenticate() error = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticateServiceBind(t *testing.T) {
+	directory := newTestDirectory(t)
+	directory.BindPassword = "wrong"
+
+	_, err := directory.Authenticate("jdoe", "jdoe-secret")
+	if err == nil || errors.Is(err, identity.ErrInvalidCredentials) {
+		t.Errorf("Authenticate() error = %v, want a bind error", err)
+	}
+}
+
+func TestLDAPAuthenticateMissingIDAttribute(t *testing.T) {
+	directory := newTestDirectory(t)
+
+	_, err := directory.Authenticate("nonum", "nonum-secret")
+	if err == nil || errors.Is(err, identity.ErrInvalidCredentials) {
+		t.Errorf("Authenticate() error = %v, want a missing attribute error", err)
+	}
+}
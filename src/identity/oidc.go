@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDC struct represents an OpenID Connect provider that users sign in through
+// IDClaim is the claim of the ID token that is mapped onto roster IDs.
+// The provider configuration is discovered from Issuer on first use, so that the application starts while the provider is unreachable.
+type OIDC struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	IDClaim      string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// AuthCodeURL returns the URL of the provider that users are redirected to in order to sign in,
+// with the state and nonce that the callback must match.
+func (p *OIDC) AuthCodeURL(ctx context.Context, redirectURL string, state string, nonce string) (string, error) {
+	config, err := p.config(ctx, redirectURL)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange redeems the authorization code the provider redirected back with,
+// and returns the identity of the verified ID token if it holds the nonce.
+func (p *OIDC) Exchange(ctx context.Context, redirectURL string, code string, nonce string) (Identity, error) {
+	config, err := p.config(ctx, redirectURL)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return Identity{}, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+	idToken, err := p.provider.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, fmt.Errorf("verifying ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return Identity{}, errors.New("ID token nonce does not match")
+	}
+
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	id, _ := claims[p.IDClaim].(string)
+	if id == "" {
+		return Identity{}, fmt.Errorf("ID token has no %s claim", p.IDClaim)
+	}
+	return Identity{Subject: idToken.Subject, ID: id}, nil
+}
+
+// config returns the OAuth2 configuration of the provider, discovering the provider on first use.
+func (p *OIDC) config(ctx context.Context, redirectURL string) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discovering %s: %w", p.Issuer, err)
+		}
+		p.provider = provider
+	}
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}, nil
+}
@@ -0,0 +1,112 @@
+package identity_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"attendance.com/src/identity"
+	"attendance.com/src/identity/identitytest"
+)
+
+const testRedirectURL = "http://attendance.test/auth/oidc/callback"
+
+func newTestProvider(t *testing.T) (*identitytest.Provider, *identity.OIDC) {
+	t.Helper()
+	provider := identitytest.NewProvider("attendance")
+	t.Cleanup(provider.Close)
+
+	return provider, &identity.OIDC{
+		Issuer:       provider.URL,
+		ClientID:     provider.ClientID,
+		ClientSecret: "client-secret",
+		IDClaim:      "preferred_username",
+	}
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	provider, client := newTestProvider(t)
+
+	authURL, err := client.AuthCodeURL(context.Background(), testRedirectURL, "the-state", "the-nonce")
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() = %q, not a URL: %v", authURL, err)
+	}
+	if got := parsed.Scheme + "://" + parsed.Host + parsed.Path; got != provider.URL+"/authorize" {
+		t.Errorf("AuthCodeURL() endpoint = %q, want %q", got, provider.URL+"/authorize")
+	}
+
+	query := parsed.Query()
+	want := map[string]string{
+		"response_type": "code",
+		"client_id":     "attendance",
+		"redirect_uri":  testRedirectURL,
+		"state":         "the-state",
+		"nonce":         "the-nonce",
+		"scope":         "openid profile email",
+	}
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("AuthCodeURL() %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	provider, client := newTestProvider(t)
+
+	code := provider.Authorize(map[string]interface{}{"sub": "sub-1", "nonce": "the-nonce", "preferred_username": "s123456"})
+	id, err := client.Exchange(context.Background(), testRedirectURL, code, "the-nonce")
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	want := identity.Identity{Subject: "sub-1", ID: "s123456"}
+	if id != want {
+		t.Errorf("Exchange() = %+v, want %+v", id, want)
+	}
+}
+
+func TestOIDCExchangeRejected(t *testing.T) {
+	provider, client := newTestProvider(t)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		code   string
+	}{
+		{"nonce of another sign-in", map[string]interface{}{"nonce": "another-nonce", "preferred_username": "s123456"}, ""},
+		{"missing nonce", map[string]interface{}{"preferred_username": "s123456"}, ""},
+		{"token of another client", map[string]interface{}{"nonce": "the-nonce", "aud": "another-client", "preferred_username": "s123456"}, ""},
+		{"token of another issuer", map[string]interface{}{"nonce": "the-nonce", "iss": "https://issuer.test", "preferred_username": "s123456"}, ""},
+		{"expired token", map[string]interface{}{"nonce": "the-nonce", "exp": time.Now().Add(-time.Hour).Unix(), "preferred_username": "s123456"}, ""},
+		{"missing ID claim", map[string]interface{}{"nonce": "the-nonce"}, ""},
+		{"unknown code", nil, "forged-code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := tt.code
+			if code == "" {
+				code = provider.Authorize(tt.claims)
+			}
+			if id, err := client.Exchange(context.Background(), testRedirectURL, code, "the-nonce"); err == nil {
+				t.Errorf("Exchange() = %+v, want an error", id)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeCodeRedeemedOnce(t *testing.T) {
+	provider, client := newTestProvider(t)
+
+	code := provider.Authorize(map[string]interface{}{"nonce": "the-nonce", "preferred_username": "s123456"})
+	if _, err := client.Exchange(context.Background(), testRedirectURL, code, "the-nonce"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if id, err := client.Exchange(context.Background(), testRedirectURL, code, "the-nonce"); err == nil {
+		t.Errorf("second Exchange() = %+v, want an error", id)
+	}
+}
@@ -10,18 +10,37 @@ Description:
 Usage:
 
 	$ go run main.go
+
+On first run, the "admin" account is created with ADMIN_PASSWORD. Admin accounts can also be managed while the server is stopped:
+
+	$ go run main.go admin create <loginID> [first] [last]
+	$ go run main.go admin password <loginID>
 */
 package main
 
 import (
 	"log"
 	"net/http"
+	"os"
+	// embeds the time zone database, so that location time zones resolve on hosts without one
+	_ "time/tzdata"
 
 	"attendance.com/src/logger"
 	"attendance.com/src/router"
+	"attendance.com/src/services"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := services.AdminCommand(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if err := services.BootstrapAdmin(); err != nil {
+		log.Fatalln(err)
+	}
+
 	http.HandleFunc("/", router.Routes)
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 
@@ -0,0 +1,142 @@
+/*
+Package notify delivers messages to users, such as password reset links and registration verification codes.
+
+The notify package exposes a Notifier interface, with drivers selected through the NOTIFIER env:
+
+  - log: the default, writes messages to the server log.
+  - file: appends messages to the file at NOTIFIER_FILE, for local use.
+  - smtp: emails messages through the server at NOTIFIER_SMTP_ADDR, from NOTIFIER_SMTP_FROM.
+    NOTIFIER_SMTP_USERNAME and NOTIFIER_SMTP_PASSWORD are used to authenticate if set.
+*/
+package notify
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"attendance.com/src/logger"
+)
+
+// Drivers supported by Open
+const (
+	DriverLog  = "log"
+	DriverFile = "file"
+	DriverSMTP = "smtp"
+)
+
+// Message struct represents a message to deliver to a user
+// Email is the address of the user, which the smtp driver requires.
+type Message struct {
+	UserID  string
+	Email   string
+	Subject string
+	Body    string
+}
+
+// Notifier is implemented by every way of delivering messages to users.
+type Notifier interface {
+	// Notify delivers a message to its user.
+	Notify(message Message) error
+}
+
+// Open returns the Notifier for the given driver.
+// An empty driver defaults to the log driver.
+// The target is only used by the file driver and defaults to notifications.log within APP_DB_PATH.
+// The smtp driver is configured through the NOTIFIER_SMTP_* envs.
+func Open(driver, target string) (Notifier, error) {
+	switch driver {
+	case "", DriverLog:
+		return logNotifier{}, nil
+	case DriverFile:
+		if target == "" {
+			target = os.Getenv("APP_DB_PATH") + "notifications.log"
+		}
+		return &fileNotifier{path: target}, nil
+	case DriverSMTP:
+		return newSMTPNotifier()
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", driver)
+	}
+}
+
+// logNotifier is the Notifier driver that writes messages to the server log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(message Message) error {
+	logger.Println(format(message, time.Now()))
+	return nil
+}
+
+// fileNotifier is the Notifier driver that appends messages to a file.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (n *fileNotifier) Notify(message Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", n.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(format(message, time.Now()) + "\n\n"); err != nil {
+		return fmt.Errorf("writing to %s: %w", n.path, err)
+	}
+	return nil
+}
+
+// smtpNotifier is the Notifier driver that emails messages.
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newSMTPNotifier returns the smtp driver configured through the NOTIFIER_SMTP_* envs.
+func newSMTPNotifier() (*smtpNotifier, error) {
+	n := &smtpNotifier{addr: os.Getenv("NOTIFIER_SMTP_ADDR"), from: os.Getenv("NOTIFIER_SMTP_FROM")}
+	if n.addr == "" || n.from == "" {
+		return nil, fmt.Errorf("NOTIFIER_SMTP_ADDR and NOTIFIER_SMTP_FROM are required by the smtp notifier")
+	}
+	host, _, err := net.SplitHostPort(n.addr)
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFIER_SMTP_ADDR must be a host:port: %w", err)
+	}
+	if username := os.Getenv("NOTIFIER_SMTP_USERNAME"); username != "" {
+		n.auth = smtp.PlainAuth("", username, os.Getenv("NOTIFIER_SMTP_PASSWORD"), host)
+	}
+	return n, nil
+}
+
+func (n *smtpNotifier) Notify(message Message) error {
+	if message.Email == "" {
+		return fmt.Errorf("no email address to notify %s", message.UserID)
+	}
+	// Header values come from the roster and the application, strip line breaks so they cannot inject headers
+	header := strings.NewReplacer("\r", "", "\n", "")
+	mail := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		header.Replace(n.from), header.Replace(message.Email), header.Replace(message.Subject),
+		strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	if err := smtp.SendMail(n.addr, n.auth, n.from, []string{message.Email}, []byte(mail)); err != nil {
+		return fmt.Errorf("emailing %s: %w", message.UserID, err)
+	}
+	return nil
+}
+
+// format renders a message as plain text.
+func format(message Message, now time.Time) string {
+	to := message.UserID
+	if message.Email != "" {
+		to += " <" + message.Email + ">"
+	}
+	return fmt.Sprintf("[%s] To: %s\nSubject: %s\n\n%s", now.Format(time.RFC3339), to, message.Subject, message.Body)
+}
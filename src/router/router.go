@@ -11,8 +11,9 @@ The Routes function supports the following paths:
 
 - /: Routes to the MainPage controller.
 - /auth: Routes to the Auth controller.
-- /admin: Routes to the Admin controller, performing admin authentication check.
-- /user: Routes to the User controller, performing user authentication check.
+- /admin: Routes to the Admin controller, checking the permission required by each path against the role of the user.
+- /user: Routes to the User controller, checking that the role of the user allows checking in.
+- /api/v1: Routes to the API controller, which authenticates requests through bearer tokens.
 
 Static Files:
 
@@ -20,7 +21,7 @@ Static files such as CSS and JavaScript are served for paths ending with ".css"
 
 Authentication and Authorization:
 
-Routes can be protected by using the checkAuth function.
+Routes can be protected by using the checkAuth function with the permission they require.
 */
 package router
 
@@ -31,6 +32,7 @@ import (
 	"attendance.com/src/controllers"
 	"attendance.com/src/logger"
 	"attendance.com/src/services"
+	"attendance.com/src/states"
 	utils "attendance.com/src/util"
 )
 
@@ -46,12 +48,14 @@ func Routes(w http.ResponseWriter, r *http.Request) {
 	case strings.HasPrefix(path, "/auth"):
 		controllers.Auth.Controller(w, r)
 	case strings.HasPrefix(path, "/admin"):
-		if isAdmin := checkAuth(w, r, true); !isAdmin {
+		if isAllowed := checkAuth(w, r, adminPermission(path)); !isAllowed {
 			break
 		}
 		controllers.Admin.Controller(w, r)
+	case strings.HasPrefix(path, "/api/v1/"):
+		controllers.API.Controller(w, r)
 	case strings.HasPrefix(path, "/user"):
-		if isAuthenticated := checkAuth(w, r, false); !isAuthenticated {
+		if isAllowed := checkAuth(w, r, states.PermCheckIn); !isAllowed {
 			break
 		}
 		controllers.User.Controller(w, r)
@@ -65,21 +69,50 @@ func Routes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// The checkAuth function is used to perform authentication and authorization checks based on the requested path.
-func checkAuth(w http.ResponseWriter, r *http.Request, adminCheck bool) bool {
-	currUser := services.Auth.GetUser(r)
+// adminPermissions maps the paths under /admin to the permission required to access them
+var adminPermissions = map[string]states.Permission{
+	"/overview":            states.PermViewAttendance,
+	"/export":              states.PermViewAttendance,
+	"/kiosk":               states.PermRunKiosk,
+	"/upload":              states.PermManageUsers,
+	"/upload/confirm":      states.PermManageUsers,
+	"/success":             states.PermManageUsers,
+	"/users":               states.PermManageUsers,
+	"/users/role":          states.PermManageUsers,
+	"/users/unlock":        states.PermManageUsers,
+	"/users/password":      states.PermManageUsers,
+	"/users/2fa":           states.PermManageUsers,
+	"/users/active":        states.PermManageUsers,
+	"/schedules":           states.PermManageSchedules,
+	"/schedules/delete":    states.PermManageSchedules,
+	"/locations":           states.PermManageLocations,
+	"/locations/delete":    states.PermManageLocations,
+	"/courses":             states.PermManageCourses,
+	"/courses/delete":      states.PermManageCourses,
+	"/courses/instructors": states.PermManageCourses,
+	"/sessions":            states.PermManageSessions,
+	"/sessions/revoke":     states.PermManageSessions,
+	"/audit":               states.PermViewAudit,
+}
 
-	if currUser.ID == "" {
-		http.Redirect(w, r, "/", http.StatusFound)
+// adminPermission returns the permission required to access a path under /admin.
+// Unknown paths require the permission to manage users, so that only administrators reach the not found page.
+func adminPermission(path string) states.Permission {
+	if permission, ok := adminPermissions[strings.TrimPrefix(path, "/admin")]; ok {
+		return permission
 	}
+	return states.PermManageUsers
+}
 
-	if !adminCheck {
-		return currUser.ID != ""
-	}
+// The checkAuth function is used to perform authentication and authorization checks based on the requested path.
+// Users who are not logged in, or whose role does not grant the permission, are redirected to the home page.
+func checkAuth(w http.ResponseWriter, r *http.Request, permission states.Permission) bool {
+	currUser := services.Auth.GetUser(r)
 
-	if currUser.ID != "admin" {
+	if currUser.ID == "" || !states.Can(currUser, permission) {
 		http.Redirect(w, r, "/", http.StatusFound)
+		return false
 	}
 
-	return currUser.ID == "admin"
+	return true
 }
@@ -1,33 +1,65 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"attendance.com/src/db"
 	"attendance.com/src/logger"
 	"attendance.com/src/states"
 	"attendance.com/src/templates"
 	utils "attendance.com/src/util"
 )
 
-// OverviewFilters struct represents the filters used in the overview page
-type OverviewFilters struct {
-	DateFrom string
-	DateTo   string
+// OverviewFilters struct represents the filters used in the overview page, export and API attendance queries
+type OverviewFilters = templates.AttendanceFilters
+
+// SessionDetails struct represents an active session listed on the sessions page
+// Handle identifies the session without exposing the session cookie value.
+type SessionDetails struct {
+	Handle    string
+	CreatedAt string
+	LastSeen  string
+	ExpiresAt string
+}
+
+// UserSessions struct represents the active sessions of a single user
+type UserSessions struct {
+	User     states.User
+	Sessions []SessionDetails
 }
 
 // AdminPageVariables struct represents the variables that are passed to the admin page template
 type AdminPageVariables struct {
-	User    states.User
-	Tab     string
-	Filters OverviewFilters
+	User      states.User
+	Tab       string
+	Filters   OverviewFilters
+	Sessions  []UserSessions
+	Schedules []ScheduleDetails
+	Locations []states.Location
+	Users     []UserDetails
+	Courses   []CourseDetails
+	// LockedAddresses are the client addresses locked out of logging in, listed on the users page
+	LockedAddresses []LockedAddress
+	Audit           []states.AuditEntry
+	// Roster is the uploaded student list shown on the upload preview page
+	Roster *RosterPreview
+	// IssuedCode is the enrollment code issued by clearing a password, shown once on the users page
+	IssuedCode *IssuedCode
+}
+
+// UserDetails struct represents a user listed on the users page, along with when their login lockout ends if they are locked out
+type UserDetails struct {
+	states.User
+	LockedUntil string
 }
 
 // AdminService struct provides methods for handling business logics for requests to the /admin endpoint
@@ -45,10 +77,11 @@ var (
 // Index handles the HTTP request to the admin index page.
 // It retrieves the current user, date filters, and tab information from the request.
 // If the tab is "overview" and the date filters are not provided, it redirects to the overview page with today's date.
+// The overview is restricted to the courses whose attendance the user can view.
 // It renders the admin page template with the provided variables.
 func (p *AdminService) Index(w http.ResponseWriter, r *http.Request) {
 	currUser := Auth.GetUser(r)
-	dateFrom, dateTo := r.FormValue("dateFrom"), r.FormValue("dateTo")
+	filters := overviewFilters(r)
 
 	// Mutex lock to ensure thread-safe access to shared Variables field
 	p.VariablesMu.Lock()
@@ -57,18 +90,57 @@ func (p *AdminService) Index(w http.ResponseWriter, r *http.Request) {
 	p.Variables.Tab = strings.Split(r.URL.Path, "/")[len(strings.Split(r.URL.Path, "/"))-1]
 
 	if p.Variables.Tab == "overview" &&
-		(dateFrom == "" || dateTo == "") {
+		(filters.DateFrom == "" || filters.DateTo == "") {
 		today := time.Now().Format("2006-01-02")
 		http.Redirect(w, r, fmt.Sprintf("/admin/overview?dateFrom=%s&dateTo=%s", today, today), http.StatusFound)
 		return
 	}
 
-	p.Variables.Filters = OverviewFilters{
-		DateFrom: dateFrom,
-		DateTo:   dateTo,
+	p.Variables.Filters = filters
+	p.Variables.Courses = nil
+	switch p.Variables.Tab {
+	case "overview":
+		if _, _, err := parseDateRange(filters.DateFrom, filters.DateTo); err != nil {
+			writeError(w, err)
+			return
+		}
+		scoped, err := scopeFilters(currUser, filters)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		p.Variables.Filters = scoped
+		p.Variables.Courses = courseList(viewableCourses(currUser))
+	case "courses", "upload":
+		p.Variables.Courses = courseList(templates.GetCourses())
 	}
 
-	err := templates.Tpl.ExecuteTemplate(w, "adminPage", p.Variables)
+	p.Variables.Sessions = nil
+	if p.Variables.Tab == "sessions" {
+		p.Variables.Sessions = activeSessions()
+	}
+	p.Variables.Schedules = nil
+	if p.Variables.Tab == "schedules" {
+		p.Variables.Schedules = scheduleList()
+	}
+	p.Variables.Users = nil
+	p.Variables.LockedAddresses = nil
+	if p.Variables.Tab == "users" {
+		p.Variables.Users = userList()
+		p.Variables.LockedAddresses = lockedAddressList()
+	}
+	p.Variables.Roster = nil
+	p.Variables.IssuedCode = nil
+	p.Variables.Audit = nil
+	if p.Variables.Tab == "audit" {
+		p.Variables.Audit = auditList()
+	}
+	p.Variables.Locations = nil
+	if p.Variables.Tab == "locations" {
+		p.Variables.Locations = templates.GetLocations()
+	}
+
+	err := renderTemplate(w, r, "adminPage", p.Variables)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Fatal("Template execution error:", err)
@@ -76,132 +148,201 @@ func (p *AdminService) Index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// UploadStudentsList handles the HTTP request to upload a CSV file containing a list of students.
-// It checks if the uploaded file is a CSV file, saves a copy of the file, and updates the user database.
-// The CSV file is also data validated to ensure it has the correct format.
-func (p *AdminService) UploadStudentsList(w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Println("error updating users.json::" + err.(error).Error())
-			http.Redirect(w, r, "/", http.StatusFound)
-		}
-	}()
+// LimitUpload caps the body of a student list upload at maxRosterBytes and parses its multipart form,
+// so that the cap already holds when the CSRF token is read from the form. Uploads exceeding it are rejected, returning false.
+func (p *AdminService) LimitUpload(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRosterBytes)
+	if err := r.ParseMultipartForm(maxRosterBytes); rosterTooLarge(err) {
+		writeError(w, rosterTooLargeError())
+		return false
+	}
+	return true
+}
 
+// UploadStudentsList handles the HTTP request to upload a CSV file or an Excel workbook containing a list of students.
+// It checks if the uploaded file is a .csv or .xlsx file, and renders a preview of the students it adds, renames and leaves unchanged,
+// along with the rows that cannot be imported. The list is only imported once the admin confirms the preview.
+// If the "sync" form value is set, the list is authoritative and the preview also lists the students it deactivates.
+func (p *AdminService) UploadStudentsList(w http.ResponseWriter, r *http.Request) {
 	file, fileInfo, err := r.FormFile("csvFile")
 	if err != nil {
 		logger.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Please choose a .csv file to upload", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	// Check if the file has a ".csv" extension.
-	if !strings.HasSuffix(fileInfo.Filename, ".csv") {
-		http.Error(w, "Invalid file format. Please upload a .csv file", http.StatusBadRequest)
+	// Check if the file has a ".csv" or ".xlsx" extension.
+	name := strings.ToLower(fileInfo.Filename)
+	if !strings.HasSuffix(name, ".csv") && !strings.HasSuffix(name, ".xlsx") {
+		http.Error(w, "Invalid file format. Please upload a .csv or .xlsx file", http.StatusBadRequest)
 		return
 	}
 
 	logger.Println(fmt.Sprint("\nFile:", file, "\nFile-HeaderProperties:", fileInfo, "\nerr: ", err))
 
-	csvData, err := utils.ReadCSV(file)
+	csvData, err := readRoster(file, strings.HasSuffix(name, ".xlsx"))
 	if err != nil {
-		logger.Println(err)
-		http.Error(w, "Error processing CSV file", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	if len(csvData[0]) != 3 {
-		http.Error(w, "Invalid CSV file format. Please ensure the CSV file has only 3 columns (ID, First Name, Last Name)", http.StatusBadRequest)
+	options := RosterImport{CourseID: r.FormValue("course"), Sync: r.FormValue("sync") == "true"}
+	course := ""
+	if options.CourseID != "" {
+		c, ok := states.GetMapCourse(options.CourseID)
+		if !ok {
+			http.Error(w, "Course not found", http.StatusBadRequest)
+			return
+		}
+		course = c.Code + " " + c.Name
+	}
+
+	plan, err := planRoster(csvData, options)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	if csvData[0][0] != "ID" || csvData[0][1] != "First" || csvData[0][2] != "Last" {
-		http.Error(w, "Invalid CSV file format. Please ensure the CSV file has header of 3 columns (ID, First, Last)", http.StatusBadRequest)
+	currUser := Auth.GetUser(r)
+	preview := RosterPreview{Course: course, Sync: options.Sync, Plan: plan}
+	if len(plan.Errors) == 0 {
+		preview.Token = holdRoster(currUser.ID, csvData, options, time.Now())
+	}
+
+	// Mutex lock to ensure thread-safe access to shared Variables field
+	p.VariablesMu.Lock()
+	defer p.VariablesMu.Unlock()
+	p.Variables = AdminPageVariables{User: currUser, Tab: "preview", Roster: &preview}
+
+	if err := renderTemplate(w, r, "adminPage", p.Variables); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Fatal("Template execution error:", err)
 		return
 	}
+}
 
-	// Create a new CSV file for saving the uploaded data.
-	// The new file will be created in the uploads folder with the name
-	// studentList_<timestamp>.csv
-	// e.g. studentList_2021-08-01_12:00:00.csv
-	saveCSV := utils.WriteCSV(fmt.Sprintf("%s/db/uploads/studentList_%s.csv", os.Getenv("APP_BASE_PATH"), time.Now().Format("2006-01-02_15:04:05")), csvData)
+// ConfirmStudentsList handles the HTTP request to import the student list previewed by the admin, given by the "token" form value.
+// The list is compared with the roster again, so that changes made to the roster since the preview are taken into account.
+func (p *AdminService) ConfirmStudentsList(w http.ResponseWriter, r *http.Request) {
+	currUser := Auth.GetUser(r)
+	pending, ok := releaseRoster(r.FormValue("token"), currUser.ID, time.Now())
+	if !ok {
+		http.Error(w, "The preview has expired, please upload the student list again.", http.StatusBadRequest)
+		return
+	}
 
-	// Update states.MapUsers with the uploaded student list
-	headlessCSVData := csvData[1:]
-	for _, line := range headlessCSVData {
-		student := states.User{
-			ID:    line[0],
-			First: line[1],
-			Last:  line[2],
-		}
+	if _, err := p.ImportStudents(currUser.ID, pending.CSVData, pending.Options); err != nil {
+		writeError(w, err)
+		return
+	}
 
-		// if the student already exists in states.MapUsers, update their name
-		if user, ok := states.GetMapUser(student.ID); ok {
-			user.First, user.Last = student.First, student.Last
-			states.SetMapUser(student.ID, user)
-			continue
-		}
+	http.Redirect(w, r, "/admin/success", http.StatusFound)
+}
 
-		states.SetMapUser(student.ID, student)
+// ImportStudents validates a student list uploaded by the actor, saves a copy of it, and updates the user database.
+// The students are enrolled in the course of the options and in the courses of their Course column. An authoritative sync unenrolls the students absent from the list
+// from the course of the options, or when no course is given deactivates them, ending their sessions. Deactivations, reactivations and unenrollments are recorded in the audit log.
+// Lists with invalid rows are refused as a whole, and enrollment codes are kept as hashes and left out of the saved copy.
+// It returns the number of students imported.
+func (p *AdminService) ImportStudents(actor string, csvData [][]string, options RosterImport) (int, error) {
+	courseID := options.CourseID
+	plan, err := planRoster(csvData, options)
+	if err != nil {
+		return 0, err
 	}
+	if len(plan.Errors) > 0 {
+		first := plan.Errors[0]
+		return 0, newServiceError(http.StatusBadRequest, fmt.Sprintf("The student list has %d invalid rows, starting with row %d: %s", len(plan.Errors), first.Row, first.Message))
+	}
+
+	// Create a new CSV file for saving the uploaded data.
+	// The new file will be created in the uploads folder with the name
+	// studentList_<timestamp>.csv
+	// e.g. studentList_2021-08-01_12:00:00.csv
+	saveCSV := utils.WriteCSV(fmt.Sprintf("%s/db/uploads/studentList_%s.csv", os.Getenv("APP_BASE_PATH"), time.Now().Format("2006-01-02_15:04:05")), withoutColumn(csvData, plan.codeCol))
 
 	// Wait for the CSV file to be saved
 	<-saveCSV
 
-	// Write MapUsers state to database
-	// Can potentially panic here if the database is not writable
-	err = db.Write(states.GetAllMapUsers(), "users.json")
-	if err != nil {
+	// Update states.MapUsers with the uploaded student list in a single write
+	if err := states.SetMapUsers(append(plan.students, plan.deactivated...)...); err != nil {
 		logger.Println(err)
+		return 0, newServiceError(http.StatusInternalServerError, "Error saving student list")
 	}
 
-	http.Redirect(w, r, "/admin/success", http.StatusFound)
+	for _, change := range plan.Reactivated {
+		recordAudit(actor, auditUserReactivated, change.ID, "student list upload")
+	}
+	for _, change := range plan.Deactivated {
+		if err := endUserSessions(change.ID, ""); err != nil {
+			logger.Println(err)
+		}
+		cancelPasswordResets(change.ID)
+		recordAudit(actor, auditUserDeactivated, change.ID, "absent from synced student list")
+	}
+
+	if courseID != "" {
+		if err := enrollStudents(courseID, plan.students); err != nil {
+			logger.Println(err)
+			return 0, newServiceError(http.StatusInternalServerError, "Error enrolling students in course")
+		}
+	}
+	if len(plan.unenrolled) > 0 {
+		if err := states.DeleteMapEnrollments(courseID, plan.unenrolled...); err != nil {
+			logger.Println(err)
+			return 0, newServiceError(http.StatusInternalServerError, "Error unenrolling students from course")
+		}
+		course, _ := states.GetMapCourse(courseID)
+		for _, id := range plan.unenrolled {
+			recordAudit(actor, auditUserUnenrolled, id, "absent from synced student list of "+course.Code)
+		}
+	}
+	for id, students := range plan.enrollments {
+		if err := enrollStudents(id, students); err != nil {
+			logger.Println(err)
+			return 0, newServiceError(http.StatusInternalServerError, "Error enrolling students in course")
+		}
+	}
+
+	return len(plan.students), nil
 }
 
 // ExportAttendanceCSV handles the HTTP request to export attendance data as a CSV file.
-// It retrieves the date filters from the request and generates the CSV data.
+// It retrieves the date, location and course filters from the request and generates the CSV data.
 // It locks the export process to ensure thread-safe access to the CSV file.
 // It writes the CSV data to a temporary file, reads the file, and copies it to the response writer.
 // Finally, it deletes the temporary file.
 func (p *AdminService) ExportAttendanceCSV(w http.ResponseWriter, r *http.Request) {
-	dateFrom, dateTo := r.FormValue("dateFrom"), r.FormValue("dateTo")
-	checkedInUsers := templates.GetCheckedInUsers(dateFrom, dateTo)
-
-	if dateFrom == "" || dateTo == "" {
-		http.Error(w, "Error exporting CSV, check to ensure a valid date range is selected.", http.StatusBadRequest)
-		return
-	}
-	dateFromTime, err := time.ParseInLocation("2006-01-02", dateFrom, time.Now().Location())
+	filters, err := scopeFilters(Auth.GetUser(r), overviewFilters(r))
 	if err != nil {
-		http.Error(w, "Error exporting CSV, check to ensure a valid date range is selected.", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	dateToTime, err := time.ParseInLocation("2006-01-02", dateTo, time.Now().Location())
+	dateFrom, dateTo := filters.DateFrom, filters.DateTo
+	dateFromTime, dateToTime, err := parseDateRange(dateFrom, dateTo)
 	if err != nil {
-		http.Error(w, "Error exporting CSV, check to ensure a valid date range is selected.", http.StatusBadRequest)
-		return
-	}
-	if dateFromTime.After(dateToTime) {
-		http.Error(w, "Error exporting CSV, check to ensure a valid date range is selected.", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
+	checkedInUsers := templates.GetCheckedInUsers(filters)
 
 	fileName := fmt.Sprintf("Attendance_%s_TO_%s.csv", dateFrom, dateTo)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
 	w.Header().Set("Content-Type", "text/csv")
 
-	// parse checkedInUsers into a [][]string csv data
-	csvData := [][]string{{"Date", "ID", "Name", "Check-In Time"}}
+	// parse checkedInUsers into a [][]string csv data, listing every enrolled user sorted by ID
+	csvData := [][]string{{"Date", "ID", "Name", "Status", "Course", "Location", "Check-In Time", "Check-Out Time", "Duration"}}
 	for dateFromTime.Before(dateToTime) || dateFromTime.Equal(dateToTime) {
 		k := dateFromTime.Format("2006-01-02")
-		if users, ok := checkedInUsers[k]; ok {
-			if users != nil {
-				for id, details := range users {
-					csvData = append(csvData, []string{k, id, details.Name, details.CheckInTime})
-				}
-			} else {
-				csvData = append(csvData, []string{k, "-", "-", "-"})
-			}
+		users := checkedInUsers[k]
+		if len(users) == 0 {
+			csvData = append(csvData, []string{k, "-", "-", "-", "-", "-", "-", "-", "-"})
+		}
+
+		for _, id := range sortedIDs(users) {
+			details := users[id]
+			csvData = append(csvData, []string{k, id, details.Name, details.Status, orDash(details.Course), orDash(details.Location), orDash(details.CheckInTime), orDash(details.CheckOutTime), orDash(details.Duration)})
 		}
 		dateFromTime = dateFromTime.AddDate(0, 0, 1)
 	}
@@ -236,3 +377,219 @@ func (p *AdminService) ExportAttendanceCSV(w http.ResponseWriter, r *http.Reques
 	}
 
 }
+
+// SetUserRole handles the HTTP request to assign the "role" form value to the "user" form value.
+// Users cannot change their own role, so that an administrator cannot lock themselves out.
+func (p *AdminService) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, role := r.FormValue("user"), r.FormValue("role")
+	if !states.IsValidRole(role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+	if userID == Auth.GetUser(r).ID {
+		http.Error(w, "You cannot change your own role", http.StatusForbidden)
+		return
+	}
+
+	user, ok := states.GetMapUser(userID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	user.Role = role
+	if err := states.SetMapUser(userID, user); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving user", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// SetUserActive handles the HTTP request to deactivate or reactivate the "user" form value from the users page,
+// depending on whether the "active" form value is "true". Deactivating a user ends their sessions and pending password resets.
+func (p *AdminService) SetUserActive(w http.ResponseWriter, r *http.Request) {
+	currUser := Auth.GetUser(r)
+	userID, active := r.FormValue("user"), r.FormValue("active") == "true"
+	if userID == currUser.ID {
+		http.Error(w, "You cannot deactivate yourself", http.StatusForbidden)
+		return
+	}
+
+	user, ok := states.GetMapUser(userID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	user.Deactivated = !active
+	if err := states.SetMapUser(userID, user); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving user", http.StatusInternalServerError)
+		return
+	}
+
+	if active {
+		recordAudit(currUser.ID, auditUserReactivated, userID, "")
+	} else {
+		if err := endUserSessions(userID, ""); err != nil {
+			logger.Println(err)
+		}
+		cancelPasswordResets(userID)
+		recordAudit(currUser.ID, auditUserDeactivated, userID, "")
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// RevokeSessions handles the HTTP request to revoke sessions from the sessions page.
+// Either a single session is revoked through its "session" handle, or every session of the "user" form value.
+func (p *AdminService) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	handle, userID := r.FormValue("session"), r.FormValue("user")
+	if handle == "" && userID == "" {
+		http.Error(w, "No session selected to revoke", http.StatusBadRequest)
+		return
+	}
+
+	revoked := []string{}
+	for id, session := range states.GetAllMapSessions() {
+		if (handle != "" && sessionHandle(id) == handle) ||
+			(handle == "" && session.UserID == userID) {
+			revoked = append(revoked, id)
+		}
+	}
+
+	if err := states.DeleteMapSessions(revoked...); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+	logger.Println(fmt.Sprintf("Revoked %d sessions", len(revoked)))
+
+	http.Redirect(w, r, "/admin/sessions", http.StatusFound)
+}
+
+// activeSessions returns the unexpired sessions grouped per user, sorted by user ID and then by last activity.
+func activeSessions() []UserSessions {
+	now := time.Now()
+	byUser := map[string]*UserSessions{}
+	lastSeen := map[string]time.Time{}
+	for id, session := range states.GetAllMapSessions() {
+		if isSessionExpired(session, now) {
+			continue
+		}
+
+		group, ok := byUser[session.UserID]
+		if !ok {
+			user, _ := states.GetMapUser(session.UserID)
+			user.ID = session.UserID
+			group = &UserSessions{User: user}
+			byUser[session.UserID] = group
+		}
+
+		expiresAt := session.CreatedAt.Add(sessionMaxAge)
+		if idleExpiry := session.LastSeen.Add(sessionIdleTimeout); idleExpiry.Before(expiresAt) {
+			expiresAt = idleExpiry
+		}
+		handle := sessionHandle(id)
+		lastSeen[handle] = session.LastSeen
+		group.Sessions = append(group.Sessions, SessionDetails{
+			Handle:    handle,
+			CreatedAt: session.CreatedAt.Format(templates.TimeFormat),
+			LastSeen:  session.LastSeen.Format(templates.TimeFormat),
+			ExpiresAt: expiresAt.Format(templates.TimeFormat),
+		})
+	}
+
+	result := make([]UserSessions, 0, len(byUser))
+	for _, group := range byUser {
+		sort.Slice(group.Sessions, func(i, j int) bool {
+			return lastSeen[group.Sessions[i].Handle].After(lastSeen[group.Sessions[j].Handle])
+		})
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].User.ID < result[j].User.ID
+	})
+
+	return result
+}
+
+// overviewFilters returns the attendance filters of the "dateFrom", "dateTo", "location" and "course" form values.
+func overviewFilters(r *http.Request) OverviewFilters {
+	return OverviewFilters{
+		DateFrom: r.FormValue("dateFrom"),
+		DateTo:   r.FormValue("dateTo"),
+		Location: r.FormValue("location"),
+		Course:   r.FormValue("course"),
+	}
+}
+
+// maxDateRangeDays is the most days an attendance report may span, since reports list every enrolled student on every day
+const maxDateRangeDays = 366
+
+// parseDateRange parses an inclusive range of "2006-01-02" dates in the server's time zone.
+// Ranges spanning more than maxDateRangeDays days are refused.
+func parseDateRange(dateFrom string, dateTo string) (time.Time, time.Time, error) {
+	errInvalid := newServiceError(http.StatusBadRequest, "Invalid date range, dateFrom and dateTo must be YYYY-MM-DD dates with dateFrom not after dateTo")
+	dateFromTime, err := time.ParseInLocation("2006-01-02", dateFrom, time.Now().Location())
+	if err != nil {
+		return time.Time{}, time.Time{}, errInvalid
+	}
+	dateToTime, err := time.ParseInLocation("2006-01-02", dateTo, time.Now().Location())
+	if err != nil {
+		return time.Time{}, time.Time{}, errInvalid
+	}
+	if dateFromTime.After(dateToTime) {
+		return time.Time{}, time.Time{}, errInvalid
+	}
+	if dateFromTime.AddDate(0, 0, maxDateRangeDays).Before(dateToTime.AddDate(0, 0, 1)) {
+		return time.Time{}, time.Time{}, newServiceError(http.StatusBadRequest, fmt.Sprintf("Invalid date range, it may span at most %d days", maxDateRangeDays))
+	}
+	return dateFromTime, dateToTime, nil
+}
+
+// userList returns every user sorted by ID, along with their login lockouts.
+func userList() []UserDetails {
+	locked := logins.lockedIDs(time.Now())
+	users := []UserDetails{}
+	for _, user := range states.GetAllMapUsers() {
+		details := UserDetails{User: user}
+		if until, ok := locked[user.ID]; ok {
+			details.LockedUntil = until.Format(templates.TimeFormat)
+		}
+		users = append(users, details)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+// orDash returns value, or "-" if it is empty, to mark missing cells in exports.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// withoutColumn returns a copy of the CSV data without the column at index col, or the data itself if col is negative.
+func withoutColumn(csvData [][]string, col int) [][]string {
+	if col < 0 {
+		return csvData
+	}
+	result := make([][]string, 0, len(csvData))
+	for _, line := range csvData {
+		row := append([]string{}, line[:col]...)
+		result = append(result, append(row, line[col+1:]...))
+	}
+	return result
+}
+
+// sessionHandle derives a stable, non-secret identifier for a session.
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
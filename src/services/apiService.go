@@ -0,0 +1,509 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+)
+
+// APIService struct provides methods for handling business logics for requests to the /api/v1 endpoint
+// Requests are authenticated with the token returned by Login, sent as an "Authorization: Bearer <token>" header.
+// Every response body is JSON, and errors are reported as {"error": {"status": <code>, "message": <message>}}.
+type APIService struct{}
+
+var (
+	// API is a global variable that provides access to the APIService methods
+	API APIService
+)
+
+// APIError struct represents the body of an API error response
+type APIError struct {
+	Error APIErrorDetails `json:"error"`
+}
+
+// APIErrorDetails struct represents the status code and message of an API error
+type APIErrorDetails struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// APILoginRequest struct represents the body of a login request
+// Code is the two-factor code or a recovery code, required from users enrolled in two-factor authentication.
+type APILoginRequest struct {
+	LoginID  string `json:"loginID"`
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+}
+
+// APILoginResponse struct represents the body of a successful login
+type APILoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	User      APIUser   `json:"user"`
+}
+
+// APICheckInRequest struct represents the optional body of a check-in request
+// If KioskToken is set, presence is proven by the kiosk QR code instead of the network of the client.
+// CourseID is required for users enrolled in courses, and must be one of their courses.
+type APICheckInRequest struct {
+	KioskToken string `json:"kioskToken"`
+	CourseID   string `json:"courseID"`
+}
+
+// APIUser struct represents a user in API responses
+type APIUser struct {
+	ID          string   `json:"id"`
+	First       string   `json:"first"`
+	Last        string   `json:"last"`
+	Role        string   `json:"role"`
+	Email       string   `json:"email,omitempty"`
+	Registered  bool     `json:"registered"`
+	Deactivated bool     `json:"deactivated,omitempty"`
+	Cohort      string   `json:"cohort,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// APIAttendance struct represents the attendance of a user on a given date in API responses
+// Status is one of "on-time", "late", "outside-session", "present" for check-ins made before statuses were tracked, or "absent".
+type APIAttendance struct {
+	Date            string     `json:"date"`
+	UserID          string     `json:"userID"`
+	Name            string     `json:"name,omitempty"`
+	Status          string     `json:"status"`
+	LocationID      string     `json:"locationID,omitempty"`
+	CourseID        string     `json:"courseID,omitempty"`
+	CheckIn         *time.Time `json:"checkIn,omitempty"`
+	CheckOut        *time.Time `json:"checkOut,omitempty"`
+	DurationSeconds int64      `json:"durationSeconds,omitempty"`
+}
+
+// APIImportResponse struct represents the body of a successful student list upload
+type APIImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+// APIImportPreview struct represents the body of a dry run of a student list upload
+// Students lists every valid row with its status, one of "added", "reactivated", "renamed" or "unchanged",
+// followed by the students an authoritative sync deactivates, with the status "deactivated" and no row.
+// The list is only imported without a dry run if Errors is empty.
+type APIImportPreview struct {
+	Students []APIImportStudent `json:"students"`
+	Errors   []APIImportError   `json:"errors"`
+}
+
+// APIImportStudent struct represents a student of a student list upload compared with the roster
+type APIImportStudent struct {
+	Row      int    `json:"row,omitempty"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// APIImportError struct represents a row of a student list upload that cannot be imported
+type APIImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// Status of attendance records in API responses, in addition to the statuses assigned at check-in
+const (
+	apiStatusPresent = "present"
+	apiStatusAbsent  = "absent"
+)
+
+// Login handles the API request to log in with a JSON {"loginID", "password"} body.
+// It returns a bearer token, which is a session like the one of the HTML login and is subject to the same expiry and revocation.
+func (a *APIService) Login(w http.ResponseWriter, r *http.Request) {
+	var body APILoginRequest
+	if err := decodeJSON(r, &body); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := Auth.Authenticate(body.LoginID, body.Password, clientAddr(r))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if user.TOTPSecret != "" {
+		if body.Code == "" {
+			writeJSONError(w, newServiceError(http.StatusUnauthorized, "Two-factor code required"))
+			return
+		}
+		if user, err = checkSecondFactor(user, body.Code, clientAddr(r)); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	token, session, err := Auth.StartSession(user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APILoginResponse{
+		Token:     token,
+		ExpiresAt: session.CreatedAt.Add(sessionMaxAge),
+		User:      newAPIUser(user),
+	})
+}
+
+// Logout handles the API request to revoke the bearer token of the request.
+func (a *APIService) Logout(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.authenticate(r, ""); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	Auth.EndSession(bearerToken(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me handles the API request to get the user the bearer token belongs to.
+func (a *APIService) Me(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, "")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIUser(user))
+}
+
+// CheckIn handles the API request to check in the user of the bearer token.
+// The client must either be on the WIFI of one of the locations, or send the token of a kiosk QR code.
+func (a *APIService) CheckIn(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, states.PermCheckIn)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var body APICheckInRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &body); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+
+	var location states.Location
+	if body.KioskToken != "" {
+		location, err = kioskLocation(body.KioskToken)
+	} else {
+		location, err = networkLocation(r, "check-in")
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	record, err := Usr.RecordCheckIn(user.ID, location, body.CourseID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIAttendance(states.AttendanceDate(record.CheckIn), user, record))
+}
+
+// CheckOut handles the API request to check out the user of the bearer token.
+// The client must be on the WIFI of one of the locations.
+func (a *APIService) CheckOut(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, states.PermCheckIn)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	location, err := networkLocation(r, "check-out")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	record, err := Usr.RecordCheckOut(user.ID, location)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIAttendance(states.AttendanceDate(record.CheckIn), user, record))
+}
+
+// Users handles the API request to list users, sorted by ID. It requires the permission to view attendance.
+// Like the attendance, users who cannot view all attendance only see the students enrolled in the courses they own.
+func (a *APIService) Users(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, states.PermViewAttendance)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	visible := func(string) bool { return true }
+	if !states.Can(user, states.PermViewAllAttendance) {
+		enrolled := map[string]bool{}
+		for _, course := range viewableCourses(user) {
+			for id := range states.GetMapCourseEnrollments(course.ID) {
+				enrolled[id] = true
+			}
+		}
+		visible = func(id string) bool { return enrolled[id] }
+	}
+
+	users := []APIUser{}
+	for _, user := range states.GetAllMapUsers() {
+		if visible(user.ID) {
+			users = append(users, newAPIUser(user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	writeJSON(w, http.StatusOK, users)
+}
+
+// Attendance handles the API request to query attendance between the "dateFrom" and "dateTo" query parameters,
+// optionally restricted to the "location" and "course" query parameters. It requires the permission to view attendance.
+// Like the overview page, every enrolled user is listed per day unless a location is given.
+func (a *APIService) Attendance(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, states.PermViewAttendance)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	filters, err := scopeFilters(user, overviewFilters(r))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	dateFromTime, dateToTime, err := parseDateRange(filters.DateFrom, filters.DateTo)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	checkedInUsers := templates.GetCheckedInUsers(filters)
+	result := []APIAttendance{}
+	for date := dateFromTime; !date.After(dateToTime); date = date.AddDate(0, 0, 1) {
+		users := checkedInUsers[date.Format("2006-01-02")]
+		ids := make([]string, 0, len(users))
+		for id := range users {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			details := users[id]
+			entry := newAPIAttendance(date, states.User{ID: id}, details.Record)
+			entry.Name = details.Name
+			if details.Absent {
+				entry.Status = apiStatusAbsent
+			}
+			result = append(result, entry)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// UploadUsers handles the API request to upload a student list. It requires the permission to manage users.
+// The CSV or Excel workbook is either sent as the "csvFile" field of a multipart form, like the upload page, or as the request body.
+// If the "course" query parameter is given, the students are also enrolled in that course.
+// With the "sync=true" query parameter, the list is authoritative and the students absent from it are unenrolled from the course, or deactivated if no course is given.
+// With the "dryRun=true" query parameter, the changes the list would make and its invalid rows are returned instead of importing it.
+func (a *APIService) UploadUsers(w http.ResponseWriter, r *http.Request) {
+	user, err := a.authenticate(r, states.PermManageUsers)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRosterBytes)
+	var file io.Reader = r.Body
+	xlsx := false
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		formFile, fileInfo, err := r.FormFile("csvFile")
+		if err != nil {
+			if rosterTooLarge(err) {
+				writeJSONError(w, rosterTooLargeError())
+				return
+			}
+			writeJSONError(w, newServiceError(http.StatusBadRequest, "Missing csvFile field"))
+			return
+		}
+		defer formFile.Close()
+		file = formFile
+		xlsx = strings.HasSuffix(strings.ToLower(fileInfo.Filename), ".xlsx")
+	case "text/csv":
+	case xlsxContentType:
+		xlsx = true
+	default:
+		writeJSONError(w, newServiceError(http.StatusUnsupportedMediaType, "Upload a text/csv or "+xlsxContentType+" body, or a multipart/form-data csvFile field"))
+		return
+	}
+
+	csvData, err := readRoster(file, xlsx)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	options := RosterImport{CourseID: r.URL.Query().Get("course"), Sync: r.URL.Query().Get("sync") == "true"}
+	if r.URL.Query().Get("dryRun") == "true" {
+		plan, err := planRoster(csvData, options)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiImportPreview(plan))
+		return
+	}
+
+	imported, err := Admin.ImportStudents(user.ID, csvData, options)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIImportResponse{Imported: imported})
+}
+
+// NotFound handles API requests to unknown endpoints.
+func (a *APIService) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, newServiceError(http.StatusNotFound, "Endpoint not found"))
+}
+
+// authenticate returns the user of the bearer token of the request, guarding that the role of the user grants the permission.
+// An empty permission only requires the user to be logged in.
+func (a *APIService) authenticate(r *http.Request, permission states.Permission) (states.User, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return states.User{}, newServiceError(http.StatusUnauthorized, "Missing bearer token")
+	}
+
+	user := Auth.SessionUser(token)
+	if user.ID == "" {
+		return states.User{}, newServiceError(http.StatusUnauthorized, "Invalid or expired bearer token")
+	}
+	if permission != "" && !states.Can(user, permission) {
+		return states.User{}, newServiceError(http.StatusForbidden, "Your role does not allow this action")
+	}
+	return user, nil
+}
+
+// bearerToken returns the token of the "Authorization: Bearer <token>" header of the request, or an empty string.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// newAPIUser converts a user to its API representation, leaving out the password hash.
+func newAPIUser(user states.User) APIUser {
+	return APIUser{
+		ID:          user.ID,
+		First:       user.First,
+		Last:        user.Last,
+		Role:        user.Role,
+		Email:       user.Email,
+		Registered:  len(user.Password) > 0,
+		Deactivated: user.Deactivated,
+		Cohort:      user.Cohort,
+		Tags:        user.Tags,
+	}
+}
+
+// newAPIAttendance converts the attendance record of a user on a date to its API representation.
+func newAPIAttendance(date time.Time, user states.User, record states.Attendance) APIAttendance {
+	entry := APIAttendance{
+		Date:       date.Format("2006-01-02"),
+		UserID:     user.ID,
+		Status:     record.Status,
+		LocationID: record.LocationID,
+		CourseID:   record.CourseID,
+	}
+	if user.First != "" || user.Last != "" {
+		entry.Name = user.First + " " + user.Last
+	}
+	if !record.CheckIn.IsZero() {
+		checkIn := record.CheckIn
+		entry.CheckIn = &checkIn
+		if entry.Status == "" {
+			entry.Status = apiStatusPresent
+		}
+	}
+	if record.IsCheckedOut() {
+		checkOut := record.CheckOut
+		entry.CheckOut = &checkOut
+		entry.DurationSeconds = int64(record.Duration().Seconds())
+	}
+	return entry
+}
+
+// decodeJSON decodes the JSON body of a request, rejecting unknown fields.
+func decodeJSON(r *http.Request, payload interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return newServiceError(http.StatusBadRequest, "Request body must not be empty")
+		}
+		return newServiceError(http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+	}
+	return nil
+}
+
+// writeJSON writes a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Println(err)
+	}
+}
+
+// writeJSONError reports an error as a JSON response.
+func writeJSONError(w http.ResponseWriter, err error) {
+	status, message := errorStatus(err)
+	writeJSON(w, status, APIError{Error: APIErrorDetails{Status: status, Message: message}})
+}
+
+// apiImportPreview converts the plan of a student list upload to its API representation, listing students in the order of their rows.
+func apiImportPreview(plan RosterPlan) APIImportPreview {
+	preview := APIImportPreview{Students: []APIImportStudent{}, Errors: []APIImportError{}}
+	for _, changes := range [][]RosterChange{plan.Added, plan.Reactivated, plan.Renamed, plan.Unchanged} {
+		for _, change := range changes {
+			preview.Students = append(preview.Students, APIImportStudent{Row: change.Row, ID: change.ID, Name: change.Name, Status: change.Status, Previous: change.Previous})
+		}
+	}
+	sort.Slice(preview.Students, func(i, j int) bool {
+		return preview.Students[i].Row < preview.Students[j].Row
+	})
+	for _, changes := range [][]RosterChange{plan.Deactivated, plan.Unenrolled} {
+		for _, change := range changes {
+			preview.Students = append(preview.Students, APIImportStudent{ID: change.ID, Name: change.Name, Status: change.Status})
+		}
+	}
+	for _, rowError := range plan.Errors {
+		preview.Errors = append(preview.Errors, APIImportError{Row: rowError.Row, Message: rowError.Message})
+	}
+	return preview
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+)
+
+// Actions recorded in the audit log
+const (
+	auditUserLockedOut    = "user-locked-out"
+	auditAddressLockedOut = "address-locked-out"
+	auditUserUnlocked     = "user-unlocked"
+	auditAddressUnlocked  = "address-unlocked"
+)
+
+// auditListLimit is the number of most recent audit entries listed on the audit page
+const auditListLimit = 200
+
+// recordAudit appends an entry to the audit log.
+// Failing to persist the entry is logged rather than failing the action being audited.
+func recordAudit(actor string, action string, subject string, detail string) {
+	entry := states.AuditEntry{
+		Time:    time.Now(),
+		Actor:   actor,
+		Action:  action,
+		Subject: subject,
+		Detail:  detail,
+	}
+	if err := states.AppendAuditLog(entry); err != nil {
+		logger.Println(err)
+	}
+}
+
+// auditList returns the most recent audit entries, newest first.
+func auditList() []states.AuditEntry {
+	entries := states.GetAuditLog()
+	if len(entries) > auditListLimit {
+		entries = entries[:auditListLimit]
+	}
+	return entries
+}
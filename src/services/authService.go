@@ -1,30 +1,31 @@
 /*
 Package services provides business logic for performing requests specific to each endpoint.
 
-Additionally, the package initializes an admin user during the package's initialization.
+Additionally, the package creates the admin user on first run from ADMIN_PASSWORD through BootstrapAdmin,
+or through the admin commands run by AdminCommand.
 */
 package services
 
 import (
+	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"attendance.com/src/db"
 	"attendance.com/src/logger"
 	"attendance.com/src/states"
-	"attendance.com/src/templates"
+	utils "attendance.com/src/util"
 	uuid "github.com/satori/go.uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // RegistrationPageVariables is a struct that represents the variables that are passed to the registration page template
+// The page also hosts the password forms, Token being the token of the password reset link that was opened.
 type RegistrationPageVariables struct {
-	User states.User
-	Tab  string
+	User  states.User
+	Tab   string
+	Token string
 }
 
 // AuthService is a struct that provides methods for handling business logics for requests to the /auth endpoint
@@ -44,108 +45,231 @@ var (
 	Auth AuthService = AuthService{}
 )
 
+// Session lifetimes, configured through envs during init
+var (
+	// sessionMaxAge is the absolute lifetime of a session since login (SESSION_MAX_AGE)
+	sessionMaxAge time.Duration
+	// sessionIdleTimeout is how long a session survives without any request (SESSION_IDLE_TIMEOUT)
+	sessionIdleTimeout time.Duration
+	// sessionSweepInterval is how often expired sessions are removed from the store (SESSION_SWEEP_INTERVAL)
+	sessionSweepInterval time.Duration
+)
+
+// sessionTouchInterval limits how often the last-seen time of a session is persisted
+const sessionTouchInterval = time.Minute
+
 func init() {
-	// init special access for admin
-	logger.Println("Initializing admin user")
-	bPassword, _ := bcrypt.GenerateFromPassword([]byte(os.Getenv("ADMIN_PASSWORD")), bcrypt.MinCost)
-	states.SetMapUser("admin", states.User{
-		ID:       "admin",
-		Password: bPassword,
-		First:    "admin",
-		Last:     "admin",
-	})
-	logger.Println("Success!")
+	sessionMaxAge = utils.GetEnvDuration("SESSION_MAX_AGE", 12*time.Hour)
+	sessionIdleTimeout = utils.GetEnvDuration("SESSION_IDLE_TIMEOUT", 2*time.Hour)
+	sessionSweepInterval = utils.GetEnvDuration("SESSION_SWEEP_INTERVAL", 5*time.Minute)
+	go sweepSessions(sessionSweepInterval)
 }
 
 // The Login method handles the processing of form submissions for user login.
 // It checks the provided login ID and password, compares the password hash, and creates a session cookie upon successful login.
-// If the login is unsuccessful, the user is redirected to the login page with an error message.
+// If the login is unsuccessful, an error message is returned.
 func (a *AuthService) Login(w http.ResponseWriter, r *http.Request) {
 	// process form submission
-	loginID := r.FormValue("loginID")
-	password := r.FormValue("password")
+	user, err := a.Authenticate(r.FormValue("loginID"), r.FormValue("password"), clientAddr(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	// check if user exist with loginID
-	myUser, ok := states.GetMapUser(loginID)
-	if !ok {
-		http.Error(w, "Login ID and/or password do not match", http.StatusUnauthorized)
+	// users enrolled in two-factor authentication get their session once their code is verified
+	if user.TOTPSecret != "" {
+		startTwoFactorLogin(w, r, user.ID)
+		http.Redirect(w, r, "/auth/2fa/verify", http.StatusSeeOther)
 		return
 	}
 
-	// Matching of password entered
-	err := bcrypt.CompareHashAndPassword(myUser.Password, []byte(password))
+	sessionID, _, err := a.StartSession(user.ID)
 	if err != nil {
-		http.Error(w, "Login ID and/or password do not match", http.StatusForbidden)
+		writeError(w, err)
 		return
 	}
+	setSessCookie(w, r, sessionID)
 
-	// create session cookie
-	c := createSessCookie(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
 
-	// map cookie value to loginID
-	states.SetMapSession(<-c, loginID)
+// Authenticate checks the provided login ID and password through the authenticators of AUTH_PROVIDERS and returns the matching user.
+// Failed attempts are counted per login ID and per client address, and either is locked out once it exceeds its limit.
+func (a *AuthService) Authenticate(loginID string, password string, addr string) (states.User, error) {
+	now := time.Now()
+	if remaining := logins.lockedFor(loginID, addr, now); remaining > 0 {
+		return states.User{}, lockedOutError(remaining)
+	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Matching of password entered
+	myUser, ok := checkPassword(loginID, password)
+	if !ok {
+		logins.fail(loginID, addr, now)
+		return states.User{}, newServiceError(http.StatusForbidden, "Login ID and/or password do not match")
+	}
+
+	if myUser.Deactivated {
+		return states.User{}, deactivatedError()
+	}
+
+	// failed logins of users enrolled in two-factor authentication are only cleared once their code matches,
+	// so that knowing the password does not allow guessing codes without being locked out
+	if myUser.TOTPSecret == "" {
+		logins.succeed(loginID)
+	}
+	return myUser, nil
+}
+
+// clientAddr returns the address of the client of the request, honoring forwarding headers from trusted proxies.
+// An empty string is returned if the address cannot be determined.
+func clientAddr(r *http.Request) string {
+	addr, err := utils.ClientAddr(r)
+	if err != nil {
+		logger.Println(err)
+		return ""
+	}
+	return addr.String()
+}
+
+// StartSession creates and persists a new session for the user, returning the session ID along with the session.
+// The session ID is used both as the value of the session cookie and as the bearer token of the API.
+// Deactivated users cannot start sessions.
+func (a *AuthService) StartSession(userID string) (string, states.Session, error) {
+	if user, ok := states.GetMapUser(userID); ok && user.Deactivated {
+		return "", states.Session{}, deactivatedError()
+	}
+
+	sessionID := uuid.NewV4().String()
+	now := time.Now()
+	session := states.Session{
+		UserID:    userID,
+		CreatedAt: now,
+		LastSeen:  now,
+		CSRFToken: randomToken(),
+	}
+	if err := states.SetMapSession(sessionID, session); err != nil {
+		return "", states.Session{}, err
+	}
+	return sessionID, session, nil
 }
 
 // Logout handles the processing of user logout requests.
 // It deletes the session cookie and redirects the user to the login page.
 func (a *AuthService) Logout(w http.ResponseWriter, r *http.Request) {
-	sessCookie, err := r.Cookie("sessCookie")
+	sessCookie, err := r.Cookie(sessCookieName)
 	if err != nil {
 		if err != http.ErrNoCookie {
 			logger.Println(err)
 		}
 	} else {
-		// delete the session
-		// this map operation is thread safe because cookie values are unique
-		delete(states.MapSessions, sessCookie.Value)
+		a.EndSession(sessCookie.Value)
 	}
 
 	// remove the cookie
-	sessCookie = &http.Cookie{
-		Name:   "sessCookie",
-		Value:  "",
-		MaxAge: -1,
-		Path:   "/",
-	}
-	http.SetCookie(w, sessCookie)
+	http.SetCookie(w, newCookie(r, sessCookieName, "", -1))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 // GetUser returns the user associated with the current session cookie.
-// If no session cookie is found, an empty user is returned.
+// If no session cookie is found, or the session has expired, an empty user is returned.
 func (a *AuthService) GetUser(r *http.Request) states.User {
-	user := states.User{}
 	// get current session cookie
-	sessCookie, err := r.Cookie("sessCookie")
+	sessCookie, err := r.Cookie(sessCookieName)
 	if err != nil {
 		if err != http.ErrNoCookie {
 			logger.Println(err)
 		}
+		return states.User{}
+	}
+
+	return a.SessionUser(sessCookie.Value)
+}
+
+// SessionUser returns the user associated with a session ID, or an empty user if the session does not exist or has expired,
+// or if its user has been deactivated.
+// Expired sessions are deleted, and the last-seen time of live sessions is refreshed.
+func (a *AuthService) SessionUser(sessionID string) states.User {
+	user := states.User{}
+	session, ok := states.GetMapSession(sessionID)
+	if !ok {
 		return user
 	}
 
-	if loginID, ok := states.GetMapSession(sessCookie.Value); ok {
-		if usr, ok := states.GetMapUser(loginID); ok {
-			user = usr
+	now := time.Now()
+	if isSessionExpired(session, now) {
+		a.EndSession(sessionID)
+		return user
+	}
+
+	if now.Sub(session.LastSeen) >= sessionTouchInterval {
+		session.LastSeen = now
+		if err := states.SetMapSession(sessionID, session); err != nil {
+			logger.Println(err)
 		}
 	}
 
+	if usr, ok := states.GetMapUser(session.UserID); ok && !usr.Deactivated {
+		user = usr
+	}
+
 	return user
 }
 
+// EndSession deletes a session, logging out the user holding it.
+func (a *AuthService) EndSession(sessionID string) {
+	if err := states.DeleteMapSessions(sessionID); err != nil {
+		logger.Println(err)
+	}
+}
+
+// isSessionExpired reports whether the session has outlived either its absolute or its idle timeout.
+func isSessionExpired(session states.Session, now time.Time) bool {
+	return now.Sub(session.CreatedAt) > sessionMaxAge ||
+		now.Sub(session.LastSeen) > sessionIdleTimeout
+}
+
+// sweepSessions periodically deletes expired sessions so that they do not accumulate in the store.
+// It is meant to be run in its own goroutine.
+func sweepSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expired := []string{}
+		for id, session := range states.GetAllMapSessions() {
+			if isSessionExpired(session, now) {
+				expired = append(expired, id)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+
+		if err := states.DeleteMapSessions(expired...); err != nil {
+			logger.Println(err)
+			continue
+		}
+		logger.Println(fmt.Sprintf("Swept %d expired sessions", len(expired)))
+	}
+}
+
 // RegisterPage renders the registration page template with the appropriate variables.
+// It also renders the password change, forgotten password and password reset forms, the change form requiring a logged in user.
 func (a *AuthService) RegisterPage(w http.ResponseWriter, r *http.Request) {
 	currUser := Auth.GetUser(r)
+	if strings.HasPrefix(r.URL.Path, "/auth/password") && currUser.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
 	// Mutex lock to ensure thread-safe access to shared Variables field
 	a.VariablesMu.Lock()
 	a.Variables.User = currUser
 	a.Variables.Tab = strings.Split(r.URL.Path, "/")[len(strings.Split(r.URL.Path, "/"))-1]
+	a.Variables.Token = r.FormValue("token")
 
-	err := templates.Tpl.ExecuteTemplate(w, "registrationPage", a.Variables)
+	err := renderTemplate(w, r, "registrationPage", a.Variables)
 	a.VariablesMu.Unlock()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -157,14 +281,8 @@ func (a *AuthService) RegisterPage(w http.ResponseWriter, r *http.Request) {
 // Register handles the processing of form submissions for user registration.
 // It checks if the user already exists, and if not, it hashes the password and registers the user.
 // If the user already exists, the user is redirected to the login page with an error message.
+// Users the student list gave an enrollment code or an email must also prove it with the "code" form value.
 func (a *AuthService) Register(w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Println("error updating users.json::" + err.(error).Error())
-			http.Redirect(w, r, "/", http.StatusFound)
-		}
-	}()
-
 	// process form submission
 	loginID := r.FormValue("loginID")
 	password := r.FormValue("password")
@@ -181,43 +299,50 @@ func (a *AuthService) Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Login ID not recognized.", http.StatusUnauthorized)
 		return
 	}
+	if user.Deactivated {
+		writeError(w, deactivatedError())
+		return
+	}
+
+	// check the password policy, before a verification code is used up
+	if err := validatePassword(loginID, password); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// check the verification code, if the student list requires one
+	if err := verifyRegistration(user, r.FormValue("code"), clientAddr(r)); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	// hash the password
-	bPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	bPassword, err := hashPassword(password)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Fatal("Password hashing error:", err)
+		writeError(w, err)
 		return
 	}
 
-	// register user
+	// register user, the enrollment code being used up
 	user.Password = bPassword
-	states.SetMapUser(loginID, user)
-
-	// Write MapUsers state to database
-	// Can potentially panic here if the database is not writable
-	err = db.Write(states.GetAllMapUsers(), "users.json")
-	if err != nil {
+	user.EnrollmentCode = ""
+	if err := states.SetMapUser(loginID, user); err != nil {
 		logger.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
+	cancelEmailedCode(loginID)
+	logins.succeed(loginID)
 
 	http.Redirect(w, r, "/auth/success", http.StatusSeeOther)
 }
 
-func createSessCookie(w http.ResponseWriter, r *http.Request) <-chan string {
-	c := make(chan string)
-
-	go func(c chan<- string) {
-		id := uuid.NewV4()
-		sessCookie := &http.Cookie{
-			Name:  "sessCookie",
-			Value: id.String(),
-			Path:  "/",
-		}
-
-		http.SetCookie(w, sessCookie)
-		c <- sessCookie.Value
-	}(c)
+// setSessCookie sets the session cookie of the response to the session ID.
+func setSessCookie(w http.ResponseWriter, r *http.Request, sessionID string) {
+	http.SetCookie(w, newCookie(r, sessCookieName, sessionID, int(sessionMaxAge.Seconds())))
+}
 
-	return c
+// deactivatedError returns the error reported to deactivated users trying to log in.
+func deactivatedError() error {
+	return newServiceError(http.StatusForbidden, "Your account has been deactivated. Please contact an administrator.")
 }
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+	uuid "github.com/satori/go.uuid"
+)
+
+// CourseDetails struct represents a course as listed in the courses tab, along with the number of students enrolled in it
+// Instructors are the names of the instructors who own the course.
+type CourseDetails struct {
+	Course      states.Course
+	Enrolled    int
+	Instructors []string
+}
+
+// CreateCourse handles the HTTP request to define a new course.
+// The "code" form value must be unique across courses, "name" is its descriptive title,
+// and the "instructors" form values are the IDs of the instructors who own it.
+func (p *AdminService) CreateCourse(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form submission", http.StatusBadRequest)
+		return
+	}
+
+	course := states.Course{
+		ID:            uuid.NewV4().String(),
+		Code:          strings.TrimSpace(r.FormValue("code")),
+		Name:          strings.TrimSpace(r.FormValue("name")),
+		InstructorIDs: r.Form["instructors"],
+	}
+	if err := validateCourse(course); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := states.SetMapCourse(course); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving course", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/courses", http.StatusFound)
+}
+
+// SetCourseInstructors handles the HTTP request to replace the instructors who own the course of the "id" form value
+// with the "instructors" form values.
+func (p *AdminService) SetCourseInstructors(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form submission", http.StatusBadRequest)
+		return
+	}
+
+	course, ok := states.GetMapCourse(r.FormValue("id"))
+	if !ok {
+		http.Error(w, "Course not found", http.StatusNotFound)
+		return
+	}
+	course.InstructorIDs = r.Form["instructors"]
+	if err := validateCourse(course); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := states.SetMapCourse(course); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving course", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/courses", http.StatusFound)
+}
+
+// DeleteCourse handles the HTTP request to remove a course along with its enrollments.
+// Attendance already recorded for the course keeps its course ID.
+func (p *AdminService) DeleteCourse(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if _, ok := states.GetMapCourse(id); !ok {
+		http.Error(w, "Course not found", http.StatusNotFound)
+		return
+	}
+
+	if err := states.DeleteMapCourse(id); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error deleting course", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/courses", http.StatusFound)
+}
+
+// validateCourse checks that a course has a code that is not used by another course, a name,
+// and that every one of its owners is an instructor.
+func validateCourse(course states.Course) error {
+	if course.Code == "" {
+		return errors.New("Code is required")
+	}
+	if course.Name == "" {
+		return errors.New("Name is required")
+	}
+	for _, id := range course.InstructorIDs {
+		if user, ok := states.GetMapUser(id); !ok || user.Role != states.RoleInstructor {
+			return errors.New("Course owners must be instructors")
+		}
+	}
+	for _, existing := range states.GetAllMapCourses() {
+		if existing.ID != course.ID && strings.EqualFold(existing.Code, course.Code) {
+			return errors.New("Code is already used by another course")
+		}
+	}
+	return nil
+}
+
+// courseList returns the courses sorted by code, along with the number of students enrolled in them and their instructors.
+func courseList(courses []states.Course) []CourseDetails {
+	result := []CourseDetails{}
+	for _, course := range courses {
+		details := CourseDetails{
+			Course:   course,
+			Enrolled: len(states.GetMapCourseEnrollments(course.ID)),
+		}
+		for _, id := range course.InstructorIDs {
+			if user, ok := states.GetMapUser(id); ok {
+				details.Instructors = append(details.Instructors, user.First+" "+user.Last)
+			}
+		}
+		result = append(result, details)
+	}
+	return result
+}
+
+// viewableCourses returns the courses whose attendance the user can view, sorted by code.
+// Users who cannot view all attendance only see the courses they own.
+func viewableCourses(user states.User) []states.Course {
+	courses := templates.GetCourses()
+	if states.Can(user, states.PermViewAllAttendance) {
+		return courses
+	}
+
+	owned := []states.Course{}
+	for _, course := range courses {
+		for _, id := range course.InstructorIDs {
+			if id == user.ID {
+				owned = append(owned, course)
+				break
+			}
+		}
+	}
+	return owned
+}
+
+// scopeFilters restricts the attendance filters to the courses whose attendance the user can view.
+// Users who can view all attendance are not restricted, and filtering on a course the user cannot view is forbidden.
+func scopeFilters(user states.User, filters OverviewFilters) (OverviewFilters, error) {
+	if states.Can(user, states.PermViewAllAttendance) {
+		return filters, nil
+	}
+
+	filters.Courses = []string{}
+	allowed := filters.Course == ""
+	for _, course := range viewableCourses(user) {
+		filters.Courses = append(filters.Courses, course.ID)
+		allowed = allowed || course.ID == filters.Course
+	}
+	if !allowed {
+		return filters, newServiceError(http.StatusForbidden, "You can only view the attendance of the courses you teach")
+	}
+	return filters, nil
+}
+
+// courseByIDOrCode returns the course with the given ID, or else the course whose code matches the value regardless of case.
+func courseByIDOrCode(value string) (states.Course, bool) {
+	if course, ok := states.GetMapCourse(value); ok {
+		return course, true
+	}
+	for _, course := range templates.GetCourses() {
+		if strings.EqualFold(course.Code, value) {
+			return course, true
+		}
+	}
+	return states.Course{}, false
+}
+
+// enrollStudents enrolls the students in a course in a single write.
+// Students who are already enrolled keep the date they were first enrolled on.
+func enrollStudents(courseID string, students []states.User) error {
+	existing := states.GetMapCourseEnrollments(courseID)
+	now := time.Now()
+	enrollments := []states.Enrollment{}
+	for _, student := range students {
+		if _, ok := existing[student.ID]; ok {
+			continue
+		}
+		enrollments = append(enrollments, states.Enrollment{CourseID: courseID, UserID: student.ID, EnrolledAt: now})
+	}
+	if len(enrollments) == 0 {
+		return nil
+	}
+	return states.SetMapEnrollments(enrollments...)
+}
+
+// checkInCourse returns the course a user checks in for, given the "course" form value.
+// Users enrolled in courses must pick one of them, while users who are not enrolled in any course check in without one.
+func checkInCourse(userID string, courseID string) (string, error) {
+	if courseID != "" {
+		if !states.IsMapEnrolled(courseID, userID) {
+			return "", newServiceError(http.StatusForbidden, "Unable to check-in. You are not enrolled in this course.")
+		}
+		return courseID, nil
+	}
+	if len(states.GetMapUserCourseIDs(userID)) > 0 {
+		return "", newServiceError(http.StatusBadRequest, "Unable to check-in. Please select the course you are checking in for.")
+	}
+	return "", nil
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+)
+
+// Names of the cookies set by the application
+const (
+	// sessCookieName holds the session ID of a logged in user
+	sessCookieName = "sessCookie"
+	// csrfCookieName holds the CSRF token of a visitor who is not logged in, for the login and registration forms
+	csrfCookieName = "csrfCookie"
+	// twoFactorCookieName holds the token of a login waiting for its two-factor code
+	twoFactorCookieName = "twoFactorCookie"
+	// oidcCookieName holds the state of a sign-in at the OIDC provider, binding the callback to the browser that started it
+	oidcCookieName = "oidcCookie"
+)
+
+// csrfFormField is the name of the form value that holds the CSRF token, rendered by the csrfField template function
+const csrfFormField = "csrfToken"
+
+// cookieSecure forces the Secure attribute on cookies (COOKIE_SECURE), for deployments behind a TLS-terminating proxy.
+// Cookies of requests served over TLS are always Secure.
+var cookieSecure bool
+
+func init() {
+	if value := os.Getenv("COOKIE_SECURE"); value != "" {
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalln("COOKIE_SECURE must be true or false")
+		}
+		cookieSecure = secure
+	}
+}
+
+// CSRFToken returns the CSRF token that forms rendered for the request must submit.
+// Logged in users get the token of their session, and other visitors a token kept in a cookie set on the response.
+func (a *AuthService) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if sessionID, session, ok := requestSession(r); ok {
+		if session.CSRFToken == "" {
+			// Sessions started before CSRF tokens existed get one on their next page
+			session.CSRFToken = randomToken()
+			if err := states.SetMapSession(sessionID, session); err != nil {
+				logger.Println(err)
+			}
+		}
+		return session.CSRFToken
+	}
+
+	if csrfCookie, err := r.Cookie(csrfCookieName); err == nil && csrfCookie.Value != "" {
+		return csrfCookie.Value
+	}
+	token := randomToken()
+	http.SetCookie(w, newCookie(r, csrfCookieName, token, 0))
+	return token
+}
+
+// ValidCSRF reports whether the request submitted the CSRF token of its session, or of its CSRF cookie if it has no session.
+func (a *AuthService) ValidCSRF(r *http.Request) bool {
+	expected := ""
+	if _, session, ok := requestSession(r); ok {
+		expected = session.CSRFToken
+	} else if csrfCookie, err := r.Cookie(csrfCookieName); err == nil {
+		expected = csrfCookie.Value
+	}
+
+	token := r.FormValue(csrfFormField)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// requestSession returns the ID and the session of the session cookie of the request, if it refers to a live session.
+func requestSession(r *http.Request) (string, states.Session, bool) {
+	sessCookie, err := r.Cookie(sessCookieName)
+	if err != nil {
+		return "", states.Session{}, false
+	}
+	session, ok := states.GetMapSession(sessCookie.Value)
+	if !ok {
+		return "", states.Session{}, false
+	}
+	return sessCookie.Value, session, true
+}
+
+// randomToken returns a random base64url-encoded token, used for CSRF tokens and password reset links.
+func randomToken() string {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		log.Fatalln("error generating random token::" + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// newCookie returns a cookie scoped to the whole site that scripts cannot read and that is not sent along cross-site requests.
+// A zero maxAge makes a cookie that lasts for the browser session, and a negative one deletes the cookie.
+func newCookie(r *http.Request, name string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   cookieSecure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// renderTemplate executes the named template with the CSRF token of the request.
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	return templates.Render(w, name, data, Auth.CSRFToken(w, r))
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/notify"
+	utils "attendance.com/src/util"
+)
+
+// emailAddressWindow is the period over which the emails requested from a client address are counted
+const emailAddressWindow = time.Hour
+
+// Email limiter configuration, set through envs during init
+var (
+	// emailResendInterval is the least time between two emails to the same user (EMAIL_RESEND_INTERVAL)
+	emailResendInterval time.Duration
+	// emailMaxPerAddress is the number of emails a client address can request per hour (EMAIL_MAX_PER_IP)
+	emailMaxPerAddress int
+)
+
+func init() {
+	emailResendInterval = utils.GetEnvDuration("EMAIL_RESEND_INTERVAL", time.Minute)
+	emailMaxPerAddress = utils.GetEnvInt("EMAIL_MAX_PER_IP", 10)
+}
+
+// emailLimiter struct tracks the emails sent to users on request, such as reset links and verification codes,
+// so that nobody can flood a user or the notifier with them. Its state is kept in memory, like the login limiter.
+type emailLimiter struct {
+	mu        sync.Mutex
+	lastSent  map[string]time.Time
+	byAddress map[string][]time.Time
+}
+
+// emails is the limiter applied to the emails users request
+var emails = emailLimiter{
+	lastSent:  map[string]time.Time{},
+	byAddress: map[string][]time.Time{},
+}
+
+// allow reports whether an email requested from the client address can be sent to the user, recording it as sent if it can.
+// Users get at most one email per EMAIL_RESEND_INTERVAL, and client addresses request at most EMAIL_MAX_PER_IP per hour.
+func (l *emailLimiter) allow(userID string, addr string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	if last, ok := l.lastSent[userID]; ok && now.Sub(last) < emailResendInterval {
+		return false
+	}
+	if addr != "" && len(l.byAddress[addr]) >= emailMaxPerAddress {
+		return false
+	}
+
+	l.lastSent[userID] = now
+	if addr != "" {
+		l.byAddress[addr] = append(l.byAddress[addr], now)
+	}
+	return true
+}
+
+// prune forgets the emails that no longer count towards a limit.
+func (l *emailLimiter) prune(now time.Time) {
+	for userID, last := range l.lastSent {
+		if now.Sub(last) >= emailResendInterval {
+			delete(l.lastSent, userID)
+		}
+	}
+	for addr, sent := range l.byAddress {
+		recent := sent[:0]
+		for _, at := range sent {
+			if now.Sub(at) < emailAddressWindow {
+				recent = append(recent, at)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.byAddress, addr)
+		} else {
+			l.byAddress[addr] = recent
+		}
+	}
+}
+
+// sendEmail delivers the message through the notifier in the background,
+// so that the time taken by the notifier does not tell whether a message was sent.
+func sendEmail(message notify.Message) {
+	go func() {
+		if err := notifier.Notify(message); err != nil {
+			logger.Println(err)
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+
+	"attendance.com/src/logger"
+)
+
+// ServiceError struct represents an error to be reported to the client, along with its HTTP status code
+// It is returned by the business logic shared between the HTML pages and the JSON API, so that each can render it in its own format.
+type ServiceError struct {
+	Status  int
+	Message string
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+// newServiceError returns a ServiceError with the given HTTP status code and message.
+func newServiceError(status int, message string) *ServiceError {
+	return &ServiceError{Status: status, Message: message}
+}
+
+// errorStatus returns the HTTP status code and message to report for an error.
+// Errors other than ServiceError are logged and reported as internal server errors, so that their details are not leaked.
+func errorStatus(err error) (int, string) {
+	var serviceErr *ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Status, serviceErr.Message
+	}
+	logger.Println(err)
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// writeError reports an error as a plain text response.
+func writeError(w http.ResponseWriter, err error) {
+	status, message := errorStatus(err)
+	http.Error(w, message, status)
+}
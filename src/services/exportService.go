@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/templates"
+	"github.com/xuri/excelize/v2"
+)
+
+// Formats of attendance exports, chosen through the "format" form value of the export
+const (
+	exportCSV        = "csv"
+	exportXLSXDays   = "xlsx"
+	exportXLSXMatrix = "xlsx-matrix"
+)
+
+// xlsxContentType is the media type of Excel workbooks
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// attendanceColumns are the columns listing the attendance of a user on a day in exports
+var attendanceColumns = []interface{}{"ID", "Name", "Status", "Course", "Location", "Check-In Time", "Check-Out Time", "Duration"}
+
+// ExportAttendance handles the HTTP request to export attendance data, in the format of the "format" form value:
+// "csv" by default, "xlsx" for an Excel workbook with one sheet per day,
+// or "xlsx-matrix" for an Excel workbook with a single sheet holding a row per student and a column per day.
+func (p *AdminService) ExportAttendance(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("format") {
+	case "", exportCSV:
+		p.ExportAttendanceCSV(w, r)
+	case exportXLSXDays, exportXLSXMatrix:
+		p.ExportAttendanceXLSX(w, r)
+	default:
+		http.Error(w, "Unknown export format", http.StatusBadRequest)
+	}
+}
+
+// ExportAttendanceXLSX handles the HTTP request to export attendance data as an Excel workbook.
+// It retrieves the date, location and course filters from the request, like the CSV export,
+// and writes the workbook straight to the response, laid out as one sheet per day or as a matrix depending on the "format" form value.
+func (p *AdminService) ExportAttendanceXLSX(w http.ResponseWriter, r *http.Request) {
+	filters, err := scopeFilters(Auth.GetUser(r), overviewFilters(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	dateFromTime, dateToTime, err := parseDateRange(filters.DateFrom, filters.DateTo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	dates := []string{}
+	for day := dateFromTime; !day.After(dateToTime); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format("2006-01-02"))
+	}
+	checkedInUsers := templates.GetCheckedInUsers(filters)
+
+	layout := attendanceDaysWorkbook
+	if r.FormValue("format") == exportXLSXMatrix {
+		layout = attendanceMatrixWorkbook
+	}
+	workbook := excelize.NewFile()
+	defer workbook.Close()
+	if err := layout(workbook, dates, checkedInUsers); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error exporting XLSX", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := fmt.Sprintf("Attendance_%s_TO_%s.xlsx", filters.DateFrom, filters.DateTo)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	w.Header().Set("Content-Type", xlsxContentType)
+	if err := workbook.Write(w); err != nil {
+		logger.Println(err)
+	}
+}
+
+// attendanceDaysWorkbook lays out the attendance as one sheet per day, named after the date and listing every user sorted by ID.
+func attendanceDaysWorkbook(workbook *excelize.File, dates []string, checkedInUsers templates.CheckedInUsers) error {
+	for i, date := range dates {
+		if i == 0 {
+			if err := workbook.SetSheetName(workbook.GetSheetName(0), date); err != nil {
+				return err
+			}
+		} else if _, err := workbook.NewSheet(date); err != nil {
+			return err
+		}
+
+		rows := [][]interface{}{attendanceColumns}
+		users := checkedInUsers[date]
+		for _, id := range sortedIDs(users) {
+			details := users[id]
+			rows = append(rows, []interface{}{id, details.Name, details.Status, details.Course, details.Location, details.CheckInTime, details.CheckOutTime, details.Duration})
+		}
+		if err := writeSheet(workbook, date, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attendanceMatrixWorkbook lays out the attendance as a single sheet with a row per user sorted by ID and a column per day,
+// each cell holding the status of the user on the day. Cells are left empty on days the user is not listed on.
+func attendanceMatrixWorkbook(workbook *excelize.File, dates []string, checkedInUsers templates.CheckedInUsers) error {
+	sheet := "Attendance"
+	if err := workbook.SetSheetName(workbook.GetSheetName(0), sheet); err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	header := []interface{}{"ID", "Name"}
+	for _, date := range dates {
+		header = append(header, date)
+		for id, details := range checkedInUsers[date] {
+			names[id] = details.Name
+		}
+	}
+
+	rows := [][]interface{}{header}
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		row := []interface{}{id, names[id]}
+		for _, date := range dates {
+			row = append(row, checkedInUsers[date][id].Status)
+		}
+		rows = append(rows, row)
+	}
+	return writeSheet(workbook, sheet, rows)
+}
+
+// writeSheet writes the rows to a sheet of the workbook, the first row being a bold header frozen above the others.
+func writeSheet(workbook *excelize.File, sheet string, rows [][]interface{}) error {
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err := workbook.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+
+	bold, err := workbook.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	if err := workbook.SetRowStyle(sheet, 1, 1, bold); err != nil {
+		return err
+	}
+	return workbook.SetPanes(sheet, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+}
+
+// sortedIDs returns the user IDs of the attendance of a day, sorted.
+func sortedIDs(users map[string]templates.AttendanceDetails) []string {
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"attendance.com/src/identity"
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password authenticators that can be listed in AUTH_PROVIDERS
+const (
+	providerLocal = "local"
+	providerLDAP  = "ldap"
+)
+
+// oidcLoginTTL is how long a user has to sign in at the OIDC provider before the callback is refused
+const oidcLoginTTL = 10 * time.Minute
+
+// Authenticator is implemented by every way of checking the password of a login ID.
+type Authenticator interface {
+	// Authenticate returns the roster user whose password matches the login ID,
+	// or identity.ErrInvalidCredentials if the authenticator does not recognize them.
+	Authenticate(loginID string, password string) (states.User, error)
+}
+
+// localAuthenticator is the Authenticator checking the bcrypt hashes of the passwords users registered with.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Authenticate(loginID string, password string) (states.User, error) {
+	user, ok := states.GetMapUser(loginID)
+	if !ok || bcrypt.CompareHashAndPassword(user.Password, []byte(password)) != nil {
+		return states.User{}, identity.ErrInvalidCredentials
+	}
+	rehashPassword(user, password)
+	return user, nil
+}
+
+// ldapAuthenticator is the Authenticator checking passwords against a directory,
+// mapping the ID attribute of the entry of the user onto a roster ID.
+type ldapAuthenticator struct {
+	directory *identity.LDAP
+}
+
+func (l ldapAuthenticator) Authenticate(loginID string, password string) (states.User, error) {
+	id, err := l.directory.Authenticate(loginID, password)
+	if err != nil {
+		return states.User{}, err
+	}
+	return rosterUser(providerLDAP, id)
+}
+
+// oidcLogin struct represents a sign-in at the OIDC provider waiting for its callback
+type oidcLogin struct {
+	Nonce     string
+	ExpiresAt time.Time
+}
+
+var (
+	// authenticators check the passwords of logins in order, the first one recognizing the password wins (AUTH_PROVIDERS)
+	authenticators []Authenticator
+	// oidcProvider is the OpenID Connect provider users can sign in through, nil if AUTH_OIDC_ISSUER is not set
+	oidcProvider *identity.OIDC
+
+	oidcLoginsMu sync.Mutex
+	// oidcLogins maps the SHA-256 of the states of pending sign-ins to their sign-in
+	oidcLogins = map[string]oidcLogin{}
+)
+
+func init() {
+	providers := os.Getenv("AUTH_PROVIDERS")
+	if providers == "" {
+		providers = providerLocal
+	}
+	for _, provider := range strings.Split(providers, ",") {
+		switch strings.TrimSpace(provider) {
+		case providerLocal:
+			authenticators = append(authenticators, localAuthenticator{})
+		case providerLDAP:
+			directory := &identity.LDAP{
+				URL:          os.Getenv("AUTH_LDAP_URL"),
+				BindDN:       os.Getenv("AUTH_LDAP_BIND_DN"),
+				BindPassword: os.Getenv("AUTH_LDAP_BIND_PASSWORD"),
+				BaseDN:       os.Getenv("AUTH_LDAP_BASE_DN"),
+				UserFilter:   envOr("AUTH_LDAP_USER_FILTER", "(uid=%s)"),
+				IDAttribute:  envOr("AUTH_LDAP_ID_ATTRIBUTE", "uid"),
+			}
+			if directory.URL == "" || directory.BaseDN == "" {
+				log.Fatalln("AUTH_LDAP_URL and AUTH_LDAP_BASE_DN are required by the ldap provider")
+			}
+			authenticators = append(authenticators, ldapAuthenticator{directory: directory})
+		default:
+			log.Fatalln(fmt.Sprintf("unknown provider %q in AUTH_PROVIDERS", provider))
+		}
+	}
+
+	if issuer := os.Getenv("AUTH_OIDC_ISSUER"); issuer != "" {
+		oidcProvider = &identity.OIDC{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("AUTH_OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("AUTH_OIDC_CLIENT_SECRET"),
+			IDClaim:      envOr("AUTH_OIDC_ID_CLAIM", "preferred_username"),
+		}
+		if oidcProvider.ClientID == "" {
+			log.Fatalln("AUTH_OIDC_CLIENT_ID is required along with AUTH_OIDC_ISSUER")
+		}
+		templates.SingleSignOn = envOr("AUTH_OIDC_NAME", "single sign-on")
+	}
+}
+
+// OIDCLogin handles the HTTP request to sign in through the OIDC provider, redirecting to it.
+func (a *AuthService) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, nonce := randomToken(), randomToken()
+	authURL, err := oidcProvider.AuthCodeURL(r.Context(), oidcRedirectURL(r), state, nonce)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "Single sign-on is unavailable, try again later.", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	oidcLoginsMu.Lock()
+	for key, login := range oidcLogins {
+		if now.After(login.ExpiresAt) {
+			delete(oidcLogins, key)
+		}
+	}
+	oidcLogins[hashToken(state)] = oidcLogin{Nonce: nonce, ExpiresAt: now.Add(oidcLoginTTL)}
+	oidcLoginsMu.Unlock()
+
+	http.SetCookie(w, newCookie(r, oidcCookieName, state, int(oidcLoginTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback handles the redirect back from the OIDC provider.
+// The "state" query value must match the sign-in started by the browser, and the "code" query value is exchanged for the identity
+// of the user, which must map onto a roster ID. Users enrolled in two-factor authentication are then asked for their code.
+func (a *AuthService) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state := r.FormValue("state")
+	oidcCookie, err := r.Cookie(oidcCookieName)
+	if err != nil || state == "" || oidcCookie.Value != state {
+		http.Error(w, "The sign-in did not start from this browser, try again.", http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, newCookie(r, oidcCookieName, "", -1))
+
+	oidcLoginsMu.Lock()
+	login, ok := oidcLogins[hashToken(state)]
+	delete(oidcLogins, hashToken(state))
+	oidcLoginsMu.Unlock()
+	if !ok || time.Now().After(login.ExpiresAt) {
+		http.Error(w, "The sign-in has expired, try again.", http.StatusForbidden)
+		return
+	}
+
+	if providerError := r.FormValue("error"); providerError != "" {
+		http.Error(w, "Sign-in was refused: "+providerError, http.StatusForbidden)
+		return
+	}
+
+	id, err := oidcProvider.Exchange(r.Context(), oidcRedirectURL(r), r.FormValue("code"), login.Nonce)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "Sign-in could not be verified, try again.", http.StatusForbidden)
+		return
+	}
+	user, err := rosterUser("oidc", id)
+	if err != nil {
+		http.Error(w, "Your account is not on the roster.", http.StatusForbidden)
+		return
+	}
+	if user.Deactivated {
+		writeError(w, deactivatedError())
+		return
+	}
+
+	if user.TOTPSecret != "" {
+		startTwoFactorLogin(w, r, user.ID)
+		http.Redirect(w, r, "/auth/2fa/verify", http.StatusSeeOther)
+		return
+	}
+	sessionID, _, err := a.StartSession(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setSessCookie(w, r, sessionID)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// checkPassword returns the roster user whose password matches the login ID, through the first authenticator recognizing it.
+// Errors of authenticators other than unrecognized passwords are logged, and the next authenticator is tried.
+func checkPassword(loginID string, password string) (states.User, bool) {
+	for _, authenticator := range authenticators {
+		user, err := authenticator.Authenticate(loginID, password)
+		if err == nil {
+			return user, true
+		}
+		if !errors.Is(err, identity.ErrInvalidCredentials) {
+			logger.Println(err)
+		}
+	}
+	return states.User{}, false
+}
+
+// rosterUser returns the roster user that an identity of an external provider maps onto.
+// Identities whose ID is not on the roster are refused as invalid credentials, and logged.
+func rosterUser(provider string, id identity.Identity) (states.User, error) {
+	user, ok := states.GetMapUser(id.ID)
+	if !ok {
+		logger.Println(fmt.Sprintf("%s identity %s maps onto %q, which is not on the roster", provider, id.Subject, id.ID))
+		return states.User{}, identity.ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// oidcRedirectURL returns the URL the OIDC provider redirects back to (AUTH_OIDC_REDIRECT_URL),
+// defaulting to the callback on the address the application was reached at.
+func oidcRedirectURL(r *http.Request) string {
+	return envOr("AUTH_OIDC_REDIRECT_URL", baseURL(r)+"/auth/oidc/callback")
+}
+
+// envOr returns the value of an env, or the fallback if it is unset.
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
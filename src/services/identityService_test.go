@@ -0,0 +1,256 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"attendance.com/src/identity"
+	"attendance.com/src/identity/identitytest"
+	"attendance.com/src/states"
+)
+
+// TestMain runs the tests from a temporary directory, so that the documents the store writes do not land in the source tree.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "attendance-services")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// addTestUsers adds the users to the roster.
+func addTestUsers(t *testing.T, users ...states.User) {
+	t.Helper()
+	if err := states.SetMapUsers(users...); err != nil {
+		t.Fatalf("SetMapUsers() error = %v", err)
+	}
+}
+
+// useTestProvider signs users in through a stub OIDC provider for the duration of the test.
+func useTestProvider(t *testing.T) *identitytest.Provider {
+	t.Helper()
+	provider := identitytest.NewProvider("attendance")
+	previous := oidcProvider
+	oidcProvider = &identity.OIDC{
+		Issuer:       provider.URL,
+		ClientID:     provider.ClientID,
+		ClientSecret: "client-secret",
+		IDClaim:      "preferred_username",
+	}
+	t.Cleanup(func() {
+		oidcProvider = previous
+		provider.Close()
+	})
+	return provider
+}
+
+// startOIDCLogin starts a sign-in through the OIDC provider, returning the state and nonce sent to the provider and the state cookie.
+func startOIDCLogin(t *testing.T) (string, string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Auth.OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("OIDCLogin() status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("OIDCLogin() redirect: %v", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcCookieName {
+			return location.Query().Get("state"), location.Query().Get("nonce"), cookie
+		}
+	}
+	t.Fatalf("OIDCLogin() set no %s cookie", oidcCookieName)
+	return "", "", nil
+}
+
+// finishOIDCLogin handles the redirect back from the OIDC provider with the state and code, sending the cookie if it is not nil.
+func finishOIDCLogin(state string, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	Auth.OIDCCallback(rec, req)
+	return rec
+}
+
+// sessionCookie returns the session cookie set by the response, or nil if it set none.
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessCookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestOIDCCallback(t *testing.T) {
+	provider := useTestProvider(t)
+	addTestUsers(t, states.User{ID: "oidc-student", First: "Oidc", Last: "Student", Role: states.RoleStudent})
+
+	state, nonce, cookie := startOIDCLogin(t)
+	code := provider.Authorize(map[string]interface{}{"sub": "sub-1", "nonce": nonce, "preferred_username": "oidc-student"})
+	rec := finishOIDCLogin(state, code, cookie)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatalf("OIDCCallback() = %d to %q, want %d to \"/\": %s", rec.Code, rec.Header().Get("Location"), http.StatusSeeOther, rec.Body)
+	}
+	sessCookie := sessionCookie(rec)
+	if sessCookie == nil {
+		t.Fatal("OIDCCallback() set no session cookie")
+	}
+	if session, ok := states.GetMapSession(sessCookie.Value); !ok || session.UserID != "oidc-student" {
+		t.Errorf("OIDCCallback() session = %+v, want a session of oidc-student", session)
+	}
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	provider := useTestProvider(t)
+	addTestUsers(t,
+		states.User{ID: "oidc-active", First: "Oidc", Last: "Active", Role: states.RoleStudent},
+		states.User{ID: "oidc-deactivated", First: "Oidc", Last: "Deactivated", Role: states.RoleStudent, Deactivated: true},
+	)
+
+	tests := []struct {
+		name string
+		// callback returns the response to the callback of a sign-in started with the state, nonce and cookie
+		callback func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder
+	}{
+		{"unknown user", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-unknown"})
+			return finishOIDCLogin(state, code, cookie)
+		}},
+		{"deactivated user", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-deactivated"})
+			return finishOIDCLogin(state, code, cookie)
+		}},
+		{"nonce of another sign-in", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": "another-nonce", "preferred_username": "oidc-active"})
+			return finishOIDCLogin(state, code, cookie)
+		}},
+		{"state of another browser", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-active"})
+			return finishOIDCLogin(state, code, &http.Cookie{Name: oidcCookieName, Value: "another-state"})
+		}},
+		{"missing state cookie", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-active"})
+			return finishOIDCLogin(state, code, nil)
+		}},
+		{"unknown state", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			code := provider.Authorize(map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-active"})
+			return finishOIDCLogin("forged-state", code, &http.Cookie{Name: oidcCookieName, Value: "forged-state"})
+		}},
+		{"forged code", func(state string, nonce string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			return finishOIDCLogin(state, "forged-code", cookie)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, nonce, cookie := startOIDCLogin(t)
+			rec := tt.callback(state, nonce, cookie)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("OIDCCallback() status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+			}
+			if sessionCookie(rec) != nil {
+				t.Error("OIDCCallback() set a session cookie")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackStateUsedOnce(t *testing.T) {
+	provider := useTestProvider(t)
+	addTestUsers(t, states.User{ID: "oidc-replayed", First: "Oidc", Last: "Replayed", Role: states.RoleStudent})
+
+	state, nonce, cookie := startOIDCLogin(t)
+	claims := map[string]interface{}{"nonce": nonce, "preferred_username": "oidc-replayed"}
+	if rec := finishOIDCLogin(state, provider.Authorize(claims), cookie); rec.Code != http.StatusSeeOther {
+		t.Fatalf("OIDCCallback() status = %d, want %d: %s", rec.Code, http.StatusSeeOther, rec.Body)
+	}
+	if rec := finishOIDCLogin(state, provider.Authorize(claims), cookie); rec.Code != http.StatusForbidden {
+		t.Errorf("replayed OIDCCallback() status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// useTestDirectory checks passwords against a stub LDAP directory only for the duration of the test,
+// mapping the employeeNumber of entries onto roster IDs.
+func useTestDirectory(t *testing.T, entries map[string]identitytest.Entry) {
+	t.Helper()
+	directory := identitytest.NewDirectory("cn=svc,dc=example,dc=org", "svc-secret", entries)
+	previous := authenticators
+	authenticators = []Authenticator{ldapAuthenticator{directory: &identity.LDAP{
+		URL:          directory.URL,
+		BindDN:       directory.BindDN,
+		BindPassword: directory.BindPassword,
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(uid=%s)",
+		IDAttribute:  "employeeNumber",
+	}}}
+	t.Cleanup(func() {
+		authenticators = previous
+		directory.Close()
+	})
+}
+
+func TestLDAPLogin(t *testing.T) {
+	useTestDirectory(t, map[string]identitytest.Entry{
+		"uid=ldap.active,ou=people,dc=example,dc=org": {
+			Password:   "active-secret",
+			Attributes: map[string]string{"uid": "ldap.active", "employeeNumber": "ldap-active"},
+		},
+		"uid=ldap.deactivated,ou=people,dc=example,dc=org": {
+			Password:   "deactivated-secret",
+			Attributes: map[string]string{"uid": "ldap.deactivated", "employeeNumber": "ldap-deactivated"},
+		},
+		"uid=ldap.unknown,ou=people,dc=example,dc=org": {
+			Password:   "unknown-secret",
+			Attributes: map[string]string{"uid": "ldap.unknown", "employeeNumber": "ldap-unknown"},
+		},
+	})
+	addTestUsers(t,
+		states.User{ID: "ldap-active", First: "Ldap", Last: "Active", Role: states.RoleStudent},
+		states.User{ID: "ldap-deactivated", First: "Ldap", Last: "Deactivated", Role: states.RoleStudent, Deactivated: true},
+	)
+
+	user, err := Auth.Authenticate("ldap.active", "active-secret", "")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if user.ID != "ldap-active" {
+		t.Errorf("Authenticate() user = %q, want %q", user.ID, "ldap-active")
+	}
+
+	tests := []struct {
+		name     string
+		loginID  string
+		password string
+		want     error
+	}{
+		{"wrong password", "ldap.active", "wrong", newServiceError(http.StatusForbidden, "Login ID and/or password do not match")},
+		{"unknown login ID", "ldap.nobody", "active-secret", newServiceError(http.StatusForbidden, "Login ID and/or password do not match")},
+		{"identity not on the roster", "ldap.unknown", "unknown-secret", newServiceError(http.StatusForbidden, "Login ID and/or password do not match")},
+		{"deactivated user", "ldap.deactivated", "deactivated-secret", deactivatedError()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := Auth.Authenticate(tt.loginID, tt.password, "")
+			var got, want *ServiceError
+			if !errors.As(err, &got) || !errors.As(tt.want, &want) || *got != *want {
+				t.Errorf("Authenticate() = %q, %v, want error %v", user.ID, err, tt.want)
+			}
+		})
+	}
+}
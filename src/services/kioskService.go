@@ -0,0 +1,202 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+	utils "attendance.com/src/util"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// KioskPageVariables struct represents the variables that are passed to the kiosk page template
+// QRCode is the PNG of the check-in URL as a data URL, and Refresh the number of seconds until the token rotates.
+type KioskPageVariables struct {
+	Location  states.Location
+	Locations []states.Location
+	QRCode    template.URL
+	Refresh   int
+	ExpiresAt string
+}
+
+// Kiosk token configuration, set through envs during init
+var (
+	// kioskSecret signs kiosk tokens (KIOSK_SECRET), a random secret is generated if it is not set
+	kioskSecret []byte
+	// kioskTokenInterval is how often the kiosk token rotates (KIOSK_TOKEN_INTERVAL)
+	kioskTokenInterval time.Duration
+)
+
+// ErrInvalidKioskToken is returned when a kiosk token is malformed, forged or expired
+var ErrInvalidKioskToken = errors.New("invalid or expired kiosk token")
+
+func init() {
+	kioskTokenInterval = utils.GetEnvDuration("KIOSK_TOKEN_INTERVAL", 30*time.Second)
+	if kioskTokenInterval < time.Second {
+		log.Fatalln("KIOSK_TOKEN_INTERVAL must be at least 1s")
+	}
+
+	kioskSecret = []byte(os.Getenv("KIOSK_SECRET"))
+	if len(kioskSecret) == 0 {
+		// Tokens signed with a generated secret do not survive restarts, which is harmless since they are short-lived
+		kioskSecret = make([]byte, 32)
+		if _, err := rand.Read(kioskSecret); err != nil {
+			log.Fatalln("error generating kiosk secret::" + err.Error())
+		}
+	}
+}
+
+// Kiosk handles the HTTP request to the kiosk page, which displays a QR code for users to check in with.
+// The QR code links to the main page with a token signed for the current interval and the "location" form value,
+// and the page refreshes itself when the token rotates.
+func (p *AdminService) Kiosk(w http.ResponseWriter, r *http.Request) {
+	variables := KioskPageVariables{Locations: templates.GetLocations()}
+	if id := r.FormValue("location"); id != "" {
+		location, ok := states.GetMapLocation(id)
+		if !ok {
+			http.Error(w, "Location not found", http.StatusNotFound)
+			return
+		}
+		variables.Location = location
+	}
+
+	now := time.Now()
+	window := kioskWindow(now)
+	token := issueKioskToken(variables.Location.ID, window)
+	png, err := qrcode.Encode(kioskCheckInURL(r, token), qrcode.Medium, 512)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "Error generating QR code", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Unix(0, 0).Add(time.Duration(window+1) * kioskTokenInterval)
+	variables.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	variables.Refresh = int(expiresAt.Sub(now).Seconds()) + 1
+	variables.ExpiresAt = expiresAt.In(locationTimezone(variables.Location)).Format(templates.TimeFormat)
+
+	if err := renderTemplate(w, r, "kioskPage", variables); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Fatal("Template execution error:", err)
+		return
+	}
+}
+
+// KioskCheckIn handles the check-in process for a user who scanned the kiosk QR code.
+// Presence is proven by the "kioskToken" form value instead of the network of the user,
+// and the attendance is recorded against the location the kiosk displays.
+func (u *UserService) KioskCheckIn(w http.ResponseWriter, r *http.Request) {
+	currUser := Auth.GetUser(r)
+	if currUser.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	location, err := kioskLocation(r.FormValue("kioskToken"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := u.RecordCheckIn(currUser.ID, location, r.FormValue("course")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/attendance/success", http.StatusFound)
+}
+
+// kioskLocation verifies a kiosk token and returns the location displayed by the kiosk it was issued for.
+func kioskLocation(token string) (states.Location, error) {
+	locationID, err := verifyKioskToken(token, time.Now())
+	if err != nil {
+		return states.Location{}, newServiceError(http.StatusForbidden, "Unable to check-in. The QR code has expired, please scan it again.")
+	}
+	if locationID == "" {
+		return states.Location{}, nil
+	}
+
+	location, ok := states.GetMapLocation(locationID)
+	if !ok {
+		return states.Location{}, newServiceError(http.StatusForbidden, "Unable to check-in. The kiosk location no longer exists.")
+	}
+	return location, nil
+}
+
+// kioskWindow returns the index of the token interval that t falls in.
+func kioskWindow(t time.Time) int64 {
+	return t.UnixNano() / int64(kioskTokenInterval)
+}
+
+// issueKioskToken signs a token for the location and interval, formatted as "<window>.<location ID>.<signature>".
+func issueKioskToken(locationID string, window int64) string {
+	payload := strconv.FormatInt(window, 10) + "." + locationID
+	return payload + "." + kioskSignature(payload)
+}
+
+// verifyKioskToken checks the signature of a kiosk token and returns the location it was issued for.
+// Tokens of the previous interval are still accepted, so that a code scanned just before it rotates remains valid.
+func verifyKioskToken(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidKioskToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(kioskSignature(payload))) {
+		return "", ErrInvalidKioskToken
+	}
+
+	window, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidKioskToken
+	}
+	if current := kioskWindow(now); window != current && window != current-1 {
+		return "", ErrInvalidKioskToken
+	}
+	return parts[1], nil
+}
+
+// kioskSignature returns the base64url-encoded HMAC-SHA256 of a kiosk token payload.
+func kioskSignature(payload string) string {
+	mac := hmac.New(sha256.New, kioskSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// publicBaseURL returns the public URL of the application configured in APP_BASE_URL, or an empty string if it is unset.
+func publicBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+}
+
+// kioskCheckInURL returns the URL encoded in the kiosk QR code.
+func kioskCheckInURL(r *http.Request, token string) string {
+	return baseURL(r) + "/?kioskToken=" + url.QueryEscape(token)
+}
+
+// baseURL returns the public URL of the application, used in links shown to the client of the request.
+// It is APP_BASE_URL if set, and otherwise built from the host the request was sent to.
+// Links sent to anyone else, such as by email, must use publicBaseURL instead, since the client controls the host.
+func baseURL(r *http.Request) string {
+	if base := publicBaseURL(); base != "" {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
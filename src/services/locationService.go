@@ -0,0 +1,116 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/templates"
+	utils "attendance.com/src/util"
+	uuid "github.com/satori/go.uuid"
+)
+
+// CreateLocation handles the HTTP request to define a new location.
+// The "networks" form value is a comma-separated list of CIDR ranges, and "timezone" an IANA time zone name.
+func (p *AdminService) CreateLocation(w http.ResponseWriter, r *http.Request) {
+	networks, err := utils.ParseNetworks(r.FormValue("networks"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	location := states.Location{
+		ID:       uuid.NewV4().String(),
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Timezone: strings.TrimSpace(r.FormValue("timezone")),
+	}
+	for _, network := range networks {
+		location.Networks = append(location.Networks, network.String())
+	}
+	if err := validateLocation(location); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := states.SetMapLocation(location); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving location", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/locations", http.StatusFound)
+}
+
+// DeleteLocation handles the HTTP request to remove a location.
+// Attendance already recorded at the location keeps its location ID.
+func (p *AdminService) DeleteLocation(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if _, ok := states.GetMapLocation(id); !ok {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	if err := states.DeleteMapLocation(id); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error deleting location", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/locations", http.StatusFound)
+}
+
+// validateLocation checks that a location has a name, at least one network and a known time zone.
+func validateLocation(location states.Location) error {
+	if location.Name == "" {
+		return errors.New("Name is required")
+	}
+	if len(location.Networks) == 0 {
+		return errors.New("At least one network is required")
+	}
+	if _, err := time.LoadLocation(location.Timezone); err != nil || location.Timezone == "" {
+		return errors.New("Timezone must be a valid IANA time zone, e.g. Asia/Singapore")
+	}
+	return nil
+}
+
+// matchLocation returns the location whose networks the request was sent from, along with whether the client is allowed to check in.
+// Locations are matched in the order they are listed. If no locations are defined, the client is validated against the
+// global VALID_IP_CIDRS instead and an empty location is returned.
+func matchLocation(r *http.Request) (states.Location, bool, error) {
+	locations := templates.GetLocations()
+	if len(locations) == 0 {
+		ok, err := utils.ValidateClientIPHandler(r)
+		return states.Location{}, ok, err
+	}
+
+	addr, err := utils.ClientAddr(r)
+	if err != nil {
+		return states.Location{}, false, err
+	}
+	for _, location := range locations {
+		networks, err := utils.ParseNetworks(strings.Join(location.Networks, ","))
+		if err != nil {
+			logger.Println(err)
+		}
+		if utils.InNetworks(addr, networks) {
+			return location, true, nil
+		}
+	}
+	return states.Location{}, false, nil
+}
+
+// locationTimezone returns the time zone of a location, defaulting to the server's time zone.
+func locationTimezone(location states.Location) *time.Location {
+	if location.Timezone == "" {
+		return time.Local
+	}
+	tz, err := time.LoadLocation(location.Timezone)
+	if err != nil {
+		logger.Println(err)
+		return time.Local
+	}
+	return tz
+}
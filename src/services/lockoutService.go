@@ -0,0 +1,265 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"attendance.com/src/templates"
+	utils "attendance.com/src/util"
+)
+
+// LockedAddress struct represents a client address that is locked out of logging in, as listed on the users page
+type LockedAddress struct {
+	Address     string
+	LockedUntil string
+}
+
+// Login limiter configuration, set through envs during init
+var (
+	// loginMaxAttempts is the number of failed logins per login ID that triggers a lockout (LOGIN_MAX_ATTEMPTS)
+	loginMaxAttempts int
+	// loginMaxAttemptsPerAddress is the number of failed logins per client address that triggers a lockout (LOGIN_MAX_ATTEMPTS_PER_IP)
+	loginMaxAttemptsPerAddress int
+	// loginAttemptWindow is how long a failed login counts towards a lockout (LOGIN_ATTEMPT_WINDOW)
+	loginAttemptWindow time.Duration
+	// loginLockout is the duration of a first lockout, doubling with each consecutive lockout (LOGIN_LOCKOUT)
+	loginLockout time.Duration
+	// loginLockoutMax caps the duration of a lockout (LOGIN_LOCKOUT_MAX)
+	loginLockoutMax time.Duration
+)
+
+func init() {
+	loginMaxAttempts = utils.GetEnvInt("LOGIN_MAX_ATTEMPTS", 5)
+	loginMaxAttemptsPerAddress = utils.GetEnvInt("LOGIN_MAX_ATTEMPTS_PER_IP", 50)
+	loginAttemptWindow = utils.GetEnvDuration("LOGIN_ATTEMPT_WINDOW", 15*time.Minute)
+	loginLockout = utils.GetEnvDuration("LOGIN_LOCKOUT", time.Minute)
+	loginLockoutMax = utils.GetEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour)
+}
+
+// loginAttempts struct tracks the failed logins of a login ID or a client address
+// Lockouts counts the consecutive lockouts, so that each one lasts twice as long as the previous one.
+type loginAttempts struct {
+	failures    []time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// loginLimiter struct tracks failed logins per login ID and per client address, locking them out when they exceed their limit
+// Its state is kept in memory, so restarting the server lifts every lockout.
+type loginLimiter struct {
+	mu        sync.Mutex
+	byID      map[string]*loginAttempts
+	byAddress map[string]*loginAttempts
+}
+
+// logins is the limiter applied to the HTML and API logins
+var logins = loginLimiter{
+	byID:      map[string]*loginAttempts{},
+	byAddress: map[string]*loginAttempts{},
+}
+
+// lockedFor returns how long logins for the login ID or from the client address remain locked out, zero if they are not.
+func (l *loginLimiter) lockedFor(loginID string, addr string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var remaining time.Duration
+	for _, attempts := range []*loginAttempts{l.byID[loginID], l.byAddress[addr]} {
+		if attempts != nil && attempts.lockedUntil.Sub(now) > remaining {
+			remaining = attempts.lockedUntil.Sub(now)
+		}
+	}
+	return remaining
+}
+
+// fail records a failed login for the login ID from the client address.
+// Lockouts it triggers are recorded in the audit log once the limiter is unlocked, so that a slow store does not hold up other logins.
+func (l *loginLimiter) fail(loginID string, addr string, now time.Time) {
+	idLockout, addressLockout := l.recordFailures(loginID, addr, now)
+
+	if idLockout > 0 {
+		recordAudit("", auditUserLockedOut, loginID,
+			fmt.Sprintf("Locked out for %s after %d failed login attempts", idLockout, loginMaxAttempts))
+	}
+	if addressLockout > 0 {
+		recordAudit("", auditAddressLockedOut, addr,
+			fmt.Sprintf("Locked out for %s after %d failed login attempts", addressLockout, loginMaxAttemptsPerAddress))
+	}
+}
+
+// recordFailures records a failed login for the login ID and the client address,
+// returning the duration of the lockouts it triggers for each, zero for those it does not lock out.
+func (l *loginLimiter) recordFailures(loginID string, addr string, now time.Time) (idLockout time.Duration, addressLockout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	if loginID != "" {
+		idLockout = recordFailure(l.byID, loginID, loginMaxAttempts, now)
+	}
+	if addr != "" {
+		addressLockout = recordFailure(l.byAddress, addr, loginMaxAttemptsPerAddress, now)
+	}
+	return idLockout, addressLockout
+}
+
+// succeed clears the failed logins of a login ID after a successful login.
+// The failed logins of the client address are kept, so that logging into one account does not reset the guessing of others.
+func (l *loginLimiter) succeed(loginID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.byID, loginID)
+}
+
+// unlockID lifts the lockout of a login ID, returning whether it was locked out.
+func (l *loginLimiter) unlockID(loginID string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	attempts, ok := l.byID[loginID]
+	delete(l.byID, loginID)
+	return ok && attempts.lockedUntil.After(now)
+}
+
+// unlockAddress lifts the lockout of a client address, returning whether it was locked out.
+func (l *loginLimiter) unlockAddress(addr string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	attempts, ok := l.byAddress[addr]
+	delete(l.byAddress, addr)
+	return ok && attempts.lockedUntil.After(now)
+}
+
+// lockedIDs returns the login IDs that are locked out along with when their lockout ends.
+func (l *loginLimiter) lockedIDs(now time.Time) map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return lockedUntil(l.byID, now)
+}
+
+// lockedAddresses returns the client addresses that are locked out along with when their lockout ends.
+func (l *loginLimiter) lockedAddresses(now time.Time) map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return lockedUntil(l.byAddress, now)
+}
+
+// prune forgets login IDs and client addresses without recent failed logins,
+// once their last lockout is far enough in the past for the backoff to start over.
+func (l *loginLimiter) prune(now time.Time) {
+	for _, byKey := range []map[string]*loginAttempts{l.byID, l.byAddress} {
+		for key, attempts := range byKey {
+			attempts.failures = recentFailures(attempts.failures, now)
+			if len(attempts.failures) == 0 && now.Sub(attempts.lockedUntil) > loginLockoutMax {
+				delete(byKey, key)
+			}
+		}
+	}
+}
+
+// recordFailure adds a failed login to the attempts of a key, and locks the key out once it reaches max failures within the window.
+// It returns the duration of the lockout it triggered, zero if none.
+func recordFailure(byKey map[string]*loginAttempts, key string, max int, now time.Time) time.Duration {
+	attempts, ok := byKey[key]
+	if !ok {
+		attempts = &loginAttempts{}
+		byKey[key] = attempts
+	}
+
+	attempts.failures = append(recentFailures(attempts.failures, now), now)
+	if len(attempts.failures) < max {
+		return 0
+	}
+
+	attempts.lockouts++
+	duration := lockoutDuration(attempts.lockouts)
+	attempts.lockedUntil = now.Add(duration)
+	attempts.failures = nil
+	return duration
+}
+
+// recentFailures returns the failed logins that are still within the attempt window.
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	recent := failures[:0]
+	for _, failure := range failures {
+		if now.Sub(failure) < loginAttemptWindow {
+			recent = append(recent, failure)
+		}
+	}
+	return recent
+}
+
+// lockoutDuration returns the duration of the nth consecutive lockout, doubling from LOGIN_LOCKOUT up to LOGIN_LOCKOUT_MAX.
+func lockoutDuration(lockouts int) time.Duration {
+	duration := loginLockout
+	for i := 1; i < lockouts && duration < loginLockoutMax; i++ {
+		duration *= 2
+	}
+	if duration > loginLockoutMax {
+		duration = loginLockoutMax
+	}
+	return duration
+}
+
+// lockedUntil returns the keys that are locked out along with when their lockout ends.
+func lockedUntil(byKey map[string]*loginAttempts, now time.Time) map[string]time.Time {
+	result := map[string]time.Time{}
+	for key, attempts := range byKey {
+		if attempts.lockedUntil.After(now) {
+			result[key] = attempts.lockedUntil
+		}
+	}
+	return result
+}
+
+// UnlockLogin handles the HTTP request to lift the login lockout of the "user" form value, or of the "address" form value.
+// Unlocks are recorded in the audit log.
+func (p *AdminService) UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	userID, addr := r.FormValue("user"), r.FormValue("address")
+	now := time.Now()
+	actor := Auth.GetUser(r).ID
+
+	switch {
+	case userID != "":
+		if logins.unlockID(userID, now) {
+			recordAudit(actor, auditUserUnlocked, userID, "Login lockout lifted")
+		}
+	case addr != "":
+		if logins.unlockAddress(addr, now) {
+			recordAudit(actor, auditAddressUnlocked, addr, "Login lockout lifted")
+		}
+	default:
+		http.Error(w, "No user or address selected to unlock", http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// lockedAddressList returns the client addresses that are locked out, sorted by address.
+func lockedAddressList() []LockedAddress {
+	addresses := []LockedAddress{}
+	for addr, until := range logins.lockedAddresses(time.Now()) {
+		addresses = append(addresses, LockedAddress{Address: addr, LockedUntil: until.Format(templates.TimeFormat)})
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].Address < addresses[j].Address
+	})
+	return addresses
+}
+
+// lockedOutError returns the error reported when logging in is locked out for the remaining duration, rounded up to the second.
+func lockedOutError(remaining time.Duration) error {
+	seconds := remaining.Truncate(time.Second)
+	if seconds < remaining {
+		seconds += time.Second
+	}
+	return newServiceError(http.StatusTooManyRequests, fmt.Sprintf("Too many failed login attempts, try again in %s", seconds))
+}
@@ -10,9 +10,11 @@ import (
 )
 
 // MainPageVariables struct represents the variables used in the main page.
+// KioskToken is set when the user opened the page by scanning a kiosk QR code.
 type MainPageVariables struct {
-	User states.User
-	Tab  string
+	User       states.User
+	Tab        string
+	KioskToken string
 }
 
 // MainService struct provides methods for handling business logics for requests to the "/" endpoint
@@ -27,22 +29,21 @@ var (
 )
 
 // Index handles the HTTP request for the main landing page.
-// It redirects the user to the admin overview page if the current user is an admin.
-// If the user is not an admin, it guards against users manually typing success routes if the "attendanceSuccess" form value is set to "success".
-// It then updates the shared Variables field and executes the "index" template.
+// It redirects the user to the admin overview page if the role of the current user does not allow checking in.
+// If the user is not an admin, it guards against users manually typing success routes if the "attendanceSuccess" form value is set to "success" or "checkout".
+// It then updates the shared Variables field, including the token of a scanned kiosk QR code, and executes the "index" template.
 func (p *MainService) Index(w http.ResponseWriter, r *http.Request) {
 	currUser := Auth.GetUser(r)
-	if currUser.ID == "admin" {
+	if currUser.ID != "" && !states.Can(currUser, states.PermCheckIn) {
 		http.Redirect(w, r, "/admin/overview", http.StatusFound)
 		return
 	}
 
 	successTab := r.FormValue("attendanceSuccess")
-	if successTab == "success" {
-		if templates.IsCheckedIn(currUser.ID) == "" {
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+	if (successTab == "success" && templates.IsCheckedIn(currUser.ID) == "") ||
+		(successTab == "checkout" && templates.IsCheckedOut(currUser.ID) == "") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
 	// Mutex lock to ensure thread-safe access to shared Variables field
@@ -50,8 +51,9 @@ func (p *MainService) Index(w http.ResponseWriter, r *http.Request) {
 	p.VariablesMu.Lock()
 	p.Variables.User = currUser
 	p.Variables.Tab = successTab
+	p.Variables.KioskToken = r.FormValue("kioskToken")
 
-	err := templates.Tpl.ExecuteTemplate(w, "index", p.Variables)
+	err := renderTemplate(w, r, "index", p.Variables)
 	p.VariablesMu.Unlock()
 
 	if err != nil {
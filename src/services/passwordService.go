@@ -0,0 +1,428 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/notify"
+	"attendance.com/src/states"
+	utils "attendance.com/src/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Actions recorded in the audit log for password changes
+const (
+	auditPasswordChanged = "password-changed"
+	auditPasswordReset   = "password-reset"
+	auditPasswordCleared = "password-cleared"
+)
+
+// passwordMaxBytes is the longest password bcrypt can hash
+const passwordMaxBytes = 72
+
+// commonPasswords is the list of common and breached passwords shipped with the application
+//
+//go:embed commonPasswords.txt
+var commonPasswords string
+
+// enrollmentCodeDigits is the number of digits of the enrollment codes issued when a password is cleared
+const enrollmentCodeDigits = 8
+
+// IssuedCode struct represents an enrollment code issued to a user, shown once to the admin who has to pass it on
+type IssuedCode struct {
+	UserID string
+	Code   string
+}
+
+// passwordReset struct represents a pending password reset of a user
+type passwordReset struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+var (
+	// notifier delivers password reset links to users (NOTIFIER, NOTIFIER_FILE)
+	notifier notify.Notifier
+	// bcryptCost is the cost passwords are hashed with (BCRYPT_COST)
+	bcryptCost int
+	// passwordResetTTL is how long a password reset link remains valid (PASSWORD_RESET_TTL)
+	passwordResetTTL time.Duration
+	// passwordMinLength is the least number of characters of a password (PASSWORD_MIN_LENGTH)
+	passwordMinLength int
+	// deniedPasswords holds the lowercased passwords the policy refuses,
+	// from the shipped list and the optional file at PASSWORD_DENYLIST_FILE
+	deniedPasswords map[string]bool
+
+	passwordResetsMu sync.Mutex
+	// passwordResets maps the SHA-256 of pending reset tokens to their reset, so that the tokens themselves are never kept
+	passwordResets = map[string]passwordReset{}
+)
+
+func init() {
+	var err error
+	if notifier, err = notify.Open(os.Getenv("NOTIFIER"), os.Getenv("NOTIFIER_FILE")); err != nil {
+		log.Fatalln("error opening notifier::" + err.Error())
+	}
+	bcryptCost = loadBcryptCost()
+	passwordResetTTL = utils.GetEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+	passwordMinLength = utils.GetEnvInt("PASSWORD_MIN_LENGTH", 8)
+	if publicBaseURL() == "" {
+		logger.Println("APP_BASE_URL is unset, password reset links will not be sent")
+	}
+
+	deniedPasswords = map[string]bool{}
+	if err := loadDeniedPasswords(strings.NewReader(commonPasswords)); err != nil {
+		log.Fatalln("error loading common passwords::" + err.Error())
+	}
+	if path := os.Getenv("PASSWORD_DENYLIST_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalln("error opening PASSWORD_DENYLIST_FILE::" + err.Error())
+		}
+		defer file.Close()
+		if err := loadDeniedPasswords(file); err != nil {
+			log.Fatalln("error loading PASSWORD_DENYLIST_FILE::" + err.Error())
+		}
+	}
+}
+
+// loadBcryptCost returns the bcrypt cost configured in BCRYPT_COST, which must be within the range bcrypt supports.
+func loadBcryptCost() int {
+	cost := utils.GetEnvInt("BCRYPT_COST", bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Fatalln(fmt.Sprintf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	return cost
+}
+
+// loadDeniedPasswords adds the passwords listed one per line to the denied passwords, skipping blank lines and # comments.
+func loadDeniedPasswords(list io.Reader) error {
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		deniedPasswords[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// ChangePassword handles the form submission of a logged in user changing their password.
+// The "current" password must match, counting as a login attempt, and every other session of the user is ended once the "password" form value is saved.
+func (a *AuthService) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	currUser := a.GetUser(r)
+	if currUser.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := checkCurrentPassword(currUser, r.FormValue("current"), clientAddr(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sessionID, _, _ := requestSession(r)
+	if err := setPassword(currUser, r.FormValue("password"), sessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAudit(currUser.ID, auditPasswordChanged, currUser.ID, "Password changed by the user")
+
+	http.Redirect(w, r, "/auth/password/changed", http.StatusSeeOther)
+}
+
+// RequestPasswordReset handles the form submission of a user who forgot their password.
+// A one-time reset link is sent through the notifier to the registered user of the "loginID" form value.
+// Links are throttled per user and per client address, and sent in the background.
+// The same page is shown whether or not the user exists, so that login IDs cannot be probed.
+// Links are built from APP_BASE_URL, never from the host of the request, and none are sent while it is unset.
+func (a *AuthService) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := states.GetMapUser(r.FormValue("loginID"))
+	base := publicBaseURL()
+	if ok && base == "" {
+		logger.Println("password reset link not sent to " + user.ID + ", APP_BASE_URL is unset")
+	}
+	now := time.Now()
+	if ok && len(user.Password) > 0 && !user.Deactivated && base != "" && emails.allow(user.ID, clientAddr(r), now) {
+		token := issuePasswordReset(user.ID, now)
+		message := notify.Message{
+			UserID:  user.ID,
+			Email:   user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Open %s/auth/reset?token=%s to choose a new password.\nThe link expires in %s and can only be used once.",
+				base, url.QueryEscape(token), passwordResetTTL),
+		}
+		sendEmail(message)
+	}
+
+	http.Redirect(w, r, "/auth/forgot/sent", http.StatusSeeOther)
+}
+
+// ResetPassword handles the form submission of a password reset link.
+// The "token" form value is only consumed once the "password" form value passes the password policy,
+// so that a rejected password does not waste the link. Every session of the user is ended once the password is saved.
+// Deactivated users cannot reset their password.
+func (a *AuthService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	token, password := r.FormValue("token"), r.FormValue("password")
+	userID, ok := lookupPasswordReset(token, time.Now())
+	if !ok {
+		http.Error(w, "The reset link is invalid or has expired, request a new one.", http.StatusForbidden)
+		return
+	}
+	user, ok := states.GetMapUser(userID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.Deactivated {
+		writeError(w, deactivatedError())
+		return
+	}
+	if err := validatePassword(user.ID, password); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, ok := consumePasswordReset(token, time.Now()); !ok {
+		http.Error(w, "The reset link is invalid or has expired, request a new one.", http.StatusForbidden)
+		return
+	}
+
+	if err := setPassword(user, password, ""); err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAudit(user.ID, auditPasswordReset, user.ID, "Password reset through a reset link")
+
+	http.Redirect(w, r, "/auth/reset/done", http.StatusSeeOther)
+}
+
+// ClearPassword handles the HTTP request to clear the password of the "user" form value, so that the user can register again.
+// Every session and pending reset link of the user is ended. Users cannot clear their own password.
+// So that nobody else can register the account in their place, users without an email are given a new enrollment code,
+// shown once to the admin on the users page, while users with an email register with a code emailed to them.
+func (p *AdminService) ClearPassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	currUser := Auth.GetUser(r)
+	if userID == currUser.ID {
+		http.Error(w, "You cannot clear your own password", http.StatusForbidden)
+		return
+	}
+
+	user, ok := states.GetMapUser(userID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	user.Password = nil
+	code := ""
+	if user.Email == "" {
+		code = randomDigits(enrollmentCodeDigits)
+		user.EnrollmentCode = hashToken(code)
+	}
+	if err := states.SetMapUser(userID, user); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving user", http.StatusInternalServerError)
+		return
+	}
+	cancelPasswordResets(userID)
+	if err := endUserSessions(userID, ""); err != nil {
+		logger.Println(err)
+	}
+	recordAudit(currUser.ID, auditPasswordCleared, userID, "Password cleared, the user must register again")
+
+	if code == "" {
+		http.Redirect(w, r, "/admin/users", http.StatusFound)
+		return
+	}
+
+	// Mutex lock to ensure thread-safe access to shared Variables field
+	p.VariablesMu.Lock()
+	defer p.VariablesMu.Unlock()
+	p.Variables = AdminPageVariables{
+		User:            currUser,
+		Tab:             "users",
+		Users:           userList(),
+		LockedAddresses: lockedAddressList(),
+		IssuedCode:      &IssuedCode{UserID: userID, Code: code},
+	}
+	if err := renderTemplate(w, r, "adminPage", p.Variables); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Fatal("Template execution error:", err)
+		return
+	}
+}
+
+// checkCurrentPassword checks the password of a logged in user confirming a sensitive change,
+// through the login limiter so that a stolen session cannot guess the password without being locked out.
+// Like logins, a match only clears the failed attempts of users not enrolled in two-factor authentication.
+func checkCurrentPassword(user states.User, password string, addr string) error {
+	now := time.Now()
+	if remaining := logins.lockedFor(user.ID, addr, now); remaining > 0 {
+		return lockedOutError(remaining)
+	}
+
+	if bcrypt.CompareHashAndPassword(user.Password, []byte(password)) != nil {
+		logins.fail(user.ID, addr, now)
+		return newServiceError(http.StatusForbidden, "Current password does not match")
+	}
+	if user.TOTPSecret == "" {
+		logins.succeed(user.ID)
+	}
+	return nil
+}
+
+// setPassword checks the new password of a user against the policy, hashes and saves it,
+// then ends every session of the user except keepSession. Pending reset links of the user are cancelled.
+func setPassword(user states.User, password string, keepSession string) error {
+	if err := validatePassword(user.ID, password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	if err := states.SetMapUser(user.ID, user); err != nil {
+		logger.Println(err)
+		return newServiceError(http.StatusInternalServerError, "Error saving password")
+	}
+	cancelPasswordResets(user.ID)
+	if err := endUserSessions(user.ID, keepSession); err != nil {
+		logger.Println(err)
+	}
+	return nil
+}
+
+// validatePassword checks a new password of a user against the password policy:
+// at least PASSWORD_MIN_LENGTH characters, at most what bcrypt can hash, not the login ID and not a denied password.
+func validatePassword(userID string, password string) error {
+	switch {
+	case password == "":
+		return newServiceError(http.StatusBadRequest, "Password is required")
+	case utf8.RuneCountInString(password) < passwordMinLength:
+		return newServiceError(http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters long", passwordMinLength))
+	case len(password) > passwordMaxBytes:
+		return newServiceError(http.StatusBadRequest, fmt.Sprintf("Password must be at most %d bytes long", passwordMaxBytes))
+	case strings.EqualFold(password, userID):
+		return newServiceError(http.StatusBadRequest, "Password must not be your login ID")
+	case deniedPasswords[strings.ToLower(password)]:
+		return newServiceError(http.StatusBadRequest, "Password is too common, choose another one")
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of a password, at the configured cost.
+func hashPassword(password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		logger.Println(err)
+		return nil, newServiceError(http.StatusInternalServerError, "Error hashing password")
+	}
+	return hash, nil
+}
+
+// rehashPassword saves the password of a user hashed at the configured cost, if its stored hash has a lower cost.
+// It is called once the password is known to match, and failing to rehash is only logged.
+func rehashPassword(user states.User, password string) {
+	if cost, err := bcrypt.Cost(user.Password); err != nil || cost >= bcryptCost {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return
+	}
+	user.Password = hash
+	if err := states.SetMapUser(user.ID, user); err != nil {
+		logger.Println(err)
+	}
+}
+
+// endUserSessions ends every session of a user except keepSession, which may be empty.
+func endUserSessions(userID string, keepSession string) error {
+	ended := []string{}
+	for id, session := range states.GetAllMapSessions() {
+		if session.UserID == userID && id != keepSession {
+			ended = append(ended, id)
+		}
+	}
+	if len(ended) == 0 {
+		return nil
+	}
+	return states.DeleteMapSessions(ended...)
+}
+
+// issuePasswordReset returns a new one-time reset token for the user, replacing any pending one.
+func issuePasswordReset(userID string, now time.Time) string {
+	token := randomToken()
+
+	passwordResetsMu.Lock()
+	defer passwordResetsMu.Unlock()
+
+	for key, reset := range passwordResets {
+		if reset.UserID == userID || now.After(reset.ExpiresAt) {
+			delete(passwordResets, key)
+		}
+	}
+	passwordResets[hashToken(token)] = passwordReset{UserID: userID, ExpiresAt: now.Add(passwordResetTTL)}
+	return token
+}
+
+// lookupPasswordReset returns the user a reset token was issued for, leaving the token valid.
+func lookupPasswordReset(token string, now time.Time) (string, bool) {
+	passwordResetsMu.Lock()
+	defer passwordResetsMu.Unlock()
+
+	reset, ok := passwordResets[hashToken(token)]
+	if !ok || token == "" || now.After(reset.ExpiresAt) {
+		return "", false
+	}
+	return reset.UserID, true
+}
+
+// consumePasswordReset returns the user a reset token was issued for, and invalidates the token.
+func consumePasswordReset(token string, now time.Time) (string, bool) {
+	passwordResetsMu.Lock()
+	defer passwordResetsMu.Unlock()
+
+	key := hashToken(token)
+	reset, ok := passwordResets[key]
+	delete(passwordResets, key)
+	if !ok || token == "" || now.After(reset.ExpiresAt) {
+		return "", false
+	}
+	return reset.UserID, true
+}
+
+// cancelPasswordResets invalidates the pending reset tokens of a user.
+func cancelPasswordResets(userID string) {
+	passwordResetsMu.Lock()
+	defer passwordResetsMu.Unlock()
+
+	for key, reset := range passwordResets {
+		if reset.UserID == userID {
+			delete(passwordResets, key)
+		}
+	}
+}
+
+// hashToken returns the SHA-256 of a secret token or code in hex, which is kept in its place so that the secret itself is never stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
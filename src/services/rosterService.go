@@ -0,0 +1,433 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	utils "attendance.com/src/util"
+)
+
+// Actions recorded in the audit log when users are deactivated or reactivated
+const (
+	auditUserDeactivated = "user-deactivated"
+	auditUserReactivated = "user-reactivated"
+	auditUserUnenrolled  = "user-unenrolled"
+)
+
+// maxRosterBytes caps the size of an uploaded student list, whether sent as a multipart form or as a raw request body.
+// It matches the memory net/http gives a multipart form before spilling it to disk.
+const maxRosterBytes = 32 << 20
+
+// maxRosterUnzipBytes caps the size an uploaded Excel workbook may unzip to, well above the ratio of genuine workbooks
+const maxRosterUnzipBytes = 10 * maxRosterBytes
+
+// Columns of a student list
+const (
+	columnID     = "ID"
+	columnFirst  = "First"
+	columnLast   = "Last"
+	columnEmail  = "Email"
+	columnCode   = "Code"
+	columnCourse = "Course"
+	columnCohort = "Cohort"
+	columnTags   = "Tags"
+)
+
+// rosterColumnAliases maps the normalized headers a student list may use to the column they stand for
+var rosterColumnAliases = map[string]string{
+	"id":             columnID,
+	"studentid":      columnID,
+	"studentnumber":  columnID,
+	"studentno":      columnID,
+	"matricnumber":   columnID,
+	"matricno":       columnID,
+	"loginid":        columnID,
+	"userid":         columnID,
+	"first":          columnFirst,
+	"firstname":      columnFirst,
+	"givenname":      columnFirst,
+	"forename":       columnFirst,
+	"last":           columnLast,
+	"lastname":       columnLast,
+	"surname":        columnLast,
+	"familyname":     columnLast,
+	"email":          columnEmail,
+	"emailaddress":   columnEmail,
+	"code":           columnCode,
+	"enrollmentcode": columnCode,
+	"enrolmentcode":  columnCode,
+	"course":         columnCourse,
+	"courses":        columnCourse,
+	"courseid":       columnCourse,
+	"coursecode":     columnCourse,
+	"cohort":         columnCohort,
+	"class":          columnCohort,
+	"group":          columnCohort,
+	"tags":           columnTags,
+	"tag":            columnTags,
+}
+
+// rosterPreviewTTL is how long an uploaded student list waits for the admin to confirm it before it has to be uploaded again
+const rosterPreviewTTL = 30 * time.Minute
+
+// Statuses of the students of an uploaded student list, compared with the roster
+const (
+	rosterAdded       = "added"
+	rosterReactivated = "reactivated"
+	rosterRenamed     = "renamed"
+	rosterUnchanged   = "unchanged"
+	rosterDeactivated = "deactivated"
+	rosterUnenrolled  = "unenrolled"
+)
+
+// RosterChange struct represents a student of an uploaded student list, compared with the roster
+// Previous is the name the student had on the roster before the upload, set for renamed students only.
+// Students deactivated or unenrolled by an authoritative sync are absent from the list, and have no Row.
+type RosterChange struct {
+	Row      int
+	ID       string
+	Name     string
+	Status   string
+	Previous string
+}
+
+// RosterRowError struct represents a row of an uploaded student list that cannot be imported
+type RosterRowError struct {
+	Row     int
+	Message string
+}
+
+// RosterImport struct represents how an uploaded student list is imported
+// If CourseID is not empty, every student of the list is enrolled in the course.
+// If Sync is set, the list is authoritative: the students absent from it are unenrolled from the course if one is given,
+// and deactivated otherwise.
+type RosterImport struct {
+	CourseID string
+	Sync     bool
+}
+
+// RosterPlan struct represents the changes an uploaded student list makes to the roster, and the rows that prevent importing it
+// Rows are numbered as in the file, the header being row 1.
+type RosterPlan struct {
+	Added       []RosterChange
+	Reactivated []RosterChange
+	Renamed     []RosterChange
+	Unchanged   []RosterChange
+	Deactivated []RosterChange
+	Unenrolled  []RosterChange
+	Errors      []RosterRowError
+
+	// students are the users of the list saved when the plan is applied, and deactivated the users absent from it
+	students    []states.User
+	deactivated []states.User
+	// unenrolled are the IDs of the students absent from the list removed from the course of the import
+	unenrolled []string
+	// enrollments maps the IDs of the courses named by the Course column to the students enrolled in them
+	enrollments map[string][]states.User
+	// codeCol is the index of the Code column of the list, or -1 if it has none
+	codeCol int
+}
+
+// RosterPreview struct represents an uploaded student list waiting for the admin to confirm it, listed on the upload preview page
+type RosterPreview struct {
+	Token  string
+	Course string
+	Sync   bool
+	Plan   RosterPlan
+}
+
+// pendingRoster struct represents an uploaded student list kept until it is confirmed
+type pendingRoster struct {
+	UploadedBy string
+	CSVData    [][]string
+	Options    RosterImport
+	ExpiresAt  time.Time
+}
+
+var (
+	pendingRostersMu sync.Mutex
+	// pendingRosters maps the SHA-256 of preview tokens to the student list they confirm
+	pendingRosters = map[string]pendingRoster{}
+)
+
+// planRoster validates the header and rows of an uploaded student list, and compares its students with the roster.
+// An invalid header fails the whole list, while invalid rows are reported in the Errors of the plan:
+// rows with a wrong number of columns, blank IDs, IDs repeating an earlier row, invalid emails and unknown courses.
+// Columns are matched by their header in any order, ignoring case, spaces and punctuation and accepting aliases such as "Student ID".
+// Besides the ID, First and Last columns, the list may have Email and Code columns that registration then requires proving,
+// a Course column of course IDs or codes the students are enrolled in, and Cohort and Tags columns kept on the students.
+// Deactivated students on the list are reactivated. If the import syncs, the students of the course of the import absent from the list
+// are unenrolled from it, or when no course is given, the active students absent from the list are deactivated.
+// Users of other roles are never deactivated or unenrolled by a sync.
+func planRoster(csvData [][]string, options RosterImport) (RosterPlan, error) {
+	course, hasCourse := states.GetMapCourse(options.CourseID)
+	if options.CourseID != "" && !hasCourse {
+		return RosterPlan{}, newServiceError(http.StatusBadRequest, "Course not found")
+	}
+	if len(csvData) == 0 {
+		return RosterPlan{}, newServiceError(http.StatusBadRequest, "The CSV file is empty. Please ensure it has a header with ID, First and Last columns")
+	}
+
+	header := csvData[0]
+	cols, err := rosterColumns(header)
+	if err != nil {
+		return RosterPlan{}, err
+	}
+	cell := func(line []string, column string) string {
+		if col, ok := cols[column]; ok {
+			return strings.TrimSpace(line[col])
+		}
+		return ""
+	}
+	_, hasEmail := cols[columnEmail]
+	_, hasCohort := cols[columnCohort]
+	_, hasTags := cols[columnTags]
+	codeCol, hasCode := cols[columnCode]
+	if !hasCode {
+		codeCol = -1
+	}
+
+	plan := RosterPlan{codeCol: codeCol, enrollments: map[string][]states.User{}}
+	seen := map[string]int{}
+	for i, line := range csvData[1:] {
+		row := i + 2
+		rowError := func(format string, a ...interface{}) {
+			plan.Errors = append(plan.Errors, RosterRowError{Row: row, Message: fmt.Sprintf(format, a...)})
+		}
+
+		if len(line) != len(header) {
+			rowError("Has %d columns instead of %d", len(line), len(header))
+			continue
+		}
+		id := cell(line, columnID)
+		if id == "" {
+			rowError("Has no ID")
+			continue
+		}
+		if first, ok := seen[id]; ok {
+			rowError("Repeats the ID %s of row %d", id, first)
+			continue
+		}
+		seen[id] = row
+
+		student := states.User{
+			ID:    id,
+			First: cell(line, columnFirst),
+			Last:  cell(line, columnLast),
+			Role:  states.RoleStudent,
+		}
+		change := RosterChange{Row: row, ID: id, Name: student.First + " " + student.Last}
+
+		// if the student already exists in states.MapUsers, update their name and keep their role
+		user, exists := states.GetMapUser(id)
+		if exists {
+			if user.First != student.First || user.Last != student.Last {
+				change.Previous = user.First + " " + user.Last
+			}
+			user.First, user.Last = student.First, student.Last
+			student = user
+		}
+
+		courseIDs := []string{}
+		unknown := ""
+		for _, value := range splitList(cell(line, columnCourse)) {
+			course, ok := courseByIDOrCode(value)
+			if !ok {
+				unknown = value
+				break
+			}
+			courseIDs = append(courseIDs, course.ID)
+		}
+		if unknown != "" {
+			rowError("Has an unknown course %q", unknown)
+			continue
+		}
+
+		// the Email, Code, Cohort and Tags columns replace the values of the student, an empty cell removing them
+		if hasEmail {
+			email := cell(line, columnEmail)
+			if email != "" {
+				if _, err := mail.ParseAddress(email); err != nil {
+					rowError("Has an invalid email %q", email)
+					continue
+				}
+			}
+			student.Email = email
+		}
+		if hasCode {
+			student.EnrollmentCode = ""
+			if code := cell(line, columnCode); code != "" {
+				student.EnrollmentCode = hashToken(code)
+			}
+		}
+		if hasCohort {
+			student.Cohort = cell(line, columnCohort)
+		}
+		if hasTags {
+			student.Tags = splitList(cell(line, columnTags))
+		}
+
+		switch {
+		case !exists:
+			change.Status = rosterAdded
+			plan.Added = append(plan.Added, change)
+		case student.Deactivated:
+			student.Deactivated = false
+			change.Status = rosterReactivated
+			plan.Reactivated = append(plan.Reactivated, change)
+		case change.Previous != "":
+			change.Status = rosterRenamed
+			plan.Renamed = append(plan.Renamed, change)
+		default:
+			change.Status = rosterUnchanged
+			plan.Unchanged = append(plan.Unchanged, change)
+		}
+		plan.students = append(plan.students, student)
+		for _, courseID := range courseIDs {
+			plan.enrollments[courseID] = append(plan.enrollments[courseID], student)
+		}
+	}
+
+	switch {
+	case options.Sync && len(seen) == 0:
+		return RosterPlan{}, newServiceError(http.StatusBadRequest, "An authoritative sync would remove every student. Please upload a student list with at least one student")
+	case options.Sync && hasCourse:
+		for id := range states.GetMapCourseEnrollments(course.ID) {
+			user, ok := states.GetMapUser(id)
+			if _, listed := seen[id]; listed || !ok || user.Role != states.RoleStudent {
+				continue
+			}
+			plan.Unenrolled = append(plan.Unenrolled, RosterChange{ID: user.ID, Name: user.First + " " + user.Last, Status: rosterUnenrolled})
+			plan.unenrolled = append(plan.unenrolled, user.ID)
+		}
+		sort.Slice(plan.Unenrolled, func(i, j int) bool {
+			return plan.Unenrolled[i].ID < plan.Unenrolled[j].ID
+		})
+	case options.Sync:
+		for _, user := range states.GetAllMapUsers() {
+			if _, ok := seen[user.ID]; ok || user.Role != states.RoleStudent || user.Deactivated {
+				continue
+			}
+			plan.Deactivated = append(plan.Deactivated, RosterChange{ID: user.ID, Name: user.First + " " + user.Last, Status: rosterDeactivated})
+			user.Deactivated = true
+			plan.deactivated = append(plan.deactivated, user)
+		}
+		sort.Slice(plan.Deactivated, func(i, j int) bool {
+			return plan.Deactivated[i].ID < plan.Deactivated[j].ID
+		})
+	}
+
+	return plan, nil
+}
+
+// readRoster reads the rows of an uploaded student list, from the first sheet of an Excel workbook if xlsx is set and from CSV otherwise.
+func readRoster(file io.Reader, xlsx bool) ([][]string, error) {
+	read, format := utils.ReadCSV, "CSV file"
+	if xlsx {
+		read, format = func(file io.Reader) ([][]string, error) { return utils.ReadXLSX(file, maxRosterUnzipBytes) }, "Excel workbook"
+	}
+	rows, err := read(file)
+	if err != nil {
+		logger.Println(err)
+		if rosterTooLarge(err) {
+			return nil, rosterTooLargeError()
+		}
+		return nil, newServiceError(http.StatusBadRequest, fmt.Sprintf("Error processing %s: %s", format, err))
+	}
+	return rows, nil
+}
+
+// rosterTooLarge returns whether reading an uploaded student list failed because it exceeds maxRosterBytes.
+func rosterTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// rosterTooLargeError returns the error reported for student lists exceeding maxRosterBytes.
+func rosterTooLargeError() error {
+	return newServiceError(http.StatusRequestEntityTooLarge, fmt.Sprintf("The student list may be at most %d MB", maxRosterBytes>>20))
+}
+
+// rosterColumns returns the index of each column of a student list, given its header.
+// Unknown and repeated columns fail the list, as do lists missing any of the ID, First and Last columns.
+func rosterColumns(header []string) (map[string]int, error) {
+	cols := map[string]int{}
+	for i, name := range header {
+		column, ok := rosterColumnAliases[normalizeColumn(name)]
+		if !ok {
+			return nil, newServiceError(http.StatusBadRequest, fmt.Sprintf("Invalid CSV file format. Unexpected column %q, the columns may be ID, First, Last, Email, Code, Course, Cohort and Tags", name))
+		}
+		if _, ok := cols[column]; ok {
+			return nil, newServiceError(http.StatusBadRequest, fmt.Sprintf("Invalid CSV file format. Column %q repeats the %s column", name, column))
+		}
+		cols[column] = i
+	}
+
+	for _, column := range []string{columnID, columnFirst, columnLast} {
+		if _, ok := cols[column]; !ok {
+			return nil, newServiceError(http.StatusBadRequest, fmt.Sprintf("Invalid CSV file format. Please ensure the CSV file has a header with ID, First and Last columns, the %s column is missing", column))
+		}
+	}
+	return cols, nil
+}
+
+// normalizeColumn returns a header of a student list lowercased, without byte order mark, spaces and punctuation.
+func normalizeColumn(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// splitList returns the trimmed, non-empty values of a cell listing several values separated by commas, semicolons or pipes.
+func splitList(value string) []string {
+	values := []string{}
+	for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' || r == '|' }) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// holdRoster keeps an uploaded student list until the admin who uploaded it confirms it, and returns the token confirming it.
+func holdRoster(uploadedBy string, csvData [][]string, options RosterImport, now time.Time) string {
+	token := randomToken()
+
+	pendingRostersMu.Lock()
+	defer pendingRostersMu.Unlock()
+
+	for key, pending := range pendingRosters {
+		if pending.UploadedBy == uploadedBy || now.After(pending.ExpiresAt) {
+			delete(pendingRosters, key)
+		}
+	}
+	pendingRosters[hashToken(token)] = pendingRoster{UploadedBy: uploadedBy, CSVData: csvData, Options: options, ExpiresAt: now.Add(rosterPreviewTTL)}
+	return token
+}
+
+// releaseRoster returns the student list a preview token confirms, if it was uploaded by the same admin, and invalidates the token.
+func releaseRoster(token string, uploadedBy string, now time.Time) (pendingRoster, bool) {
+	pendingRostersMu.Lock()
+	defer pendingRostersMu.Unlock()
+
+	key := hashToken(token)
+	pending, ok := pendingRosters[key]
+	if !ok || token == "" || pending.UploadedBy != uploadedBy || now.After(pending.ExpiresAt) {
+		return pendingRoster{}, false
+	}
+	delete(pendingRosters, key)
+	return pending, true
+}
@@ -0,0 +1,374 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	utils "attendance.com/src/util"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ScheduleDetails struct represents a class schedule listed on the schedules page, along with a readable summary of when it occurs
+type ScheduleDetails struct {
+	states.Schedule
+	Summary string
+}
+
+// recurrence is the parsed form of a schedule's recurrence rule
+type recurrence struct {
+	freq  string
+	days  map[time.Weekday]bool
+	until time.Time
+}
+
+// Frequencies supported in recurrence rules
+const (
+	freqDaily  = "DAILY"
+	freqWeekly = "WEEKLY"
+)
+
+// weekdayCodes maps the BYDAY codes of recurrence rules to weekdays, in the order they are displayed
+var weekdayCodes = []struct {
+	Code string
+	Day  time.Weekday
+}{
+	{"MO", time.Monday},
+	{"TU", time.Tuesday},
+	{"WE", time.Wednesday},
+	{"TH", time.Thursday},
+	{"FR", time.Friday},
+	{"SA", time.Saturday},
+	{"SU", time.Sunday},
+}
+
+// checkInOpensBefore is how long before a session starts that a check-in counts towards it (CHECKIN_OPENS_BEFORE)
+var checkInOpensBefore time.Duration
+
+func init() {
+	checkInOpensBefore = utils.GetEnvDuration("CHECKIN_OPENS_BEFORE", 30*time.Minute)
+}
+
+// CreateSchedule handles the HTTP request to define a new class schedule.
+// The recurrence rule is built from the "frequency", "days" and "until" form values, and the schedule is validated before it is saved.
+func (p *AdminService) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form submission", http.StatusBadRequest)
+		return
+	}
+
+	grace, err := strconv.Atoi(r.FormValue("grace"))
+	if err != nil {
+		http.Error(w, "Grace period must be a number of minutes", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := buildRecurrence(r.FormValue("frequency"), r.Form["days"], r.FormValue("until"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	course, ok := states.GetMapCourse(r.FormValue("course"))
+	if !ok {
+		http.Error(w, "Course is required", http.StatusBadRequest)
+		return
+	}
+
+	schedule := states.Schedule{
+		ID:           uuid.NewV4().String(),
+		CourseID:     course.ID,
+		Course:       course.Code,
+		StartDate:    r.FormValue("startDate"),
+		StartTime:    r.FormValue("startTime"),
+		EndTime:      r.FormValue("endTime"),
+		GraceMinutes: grace,
+		Recurrence:   rule,
+	}
+	if err := validateSchedule(schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := states.SetMapSchedule(schedule); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving schedule", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/schedules", http.StatusFound)
+}
+
+// DeleteSchedule handles the HTTP request to remove a class schedule.
+// Attendance already tagged against the schedule keeps its status.
+func (p *AdminService) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if _, ok := states.GetMapSchedule(id); !ok {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	if err := states.DeleteMapSchedule(id); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error deleting schedule", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/schedules", http.StatusFound)
+}
+
+// scheduleList returns all schedules sorted by course, start date and start time, along with their summaries.
+func scheduleList() []ScheduleDetails {
+	result := []ScheduleDetails{}
+	for _, schedule := range states.GetAllMapSchedules() {
+		result = append(result, ScheduleDetails{
+			Schedule: schedule,
+			Summary:  describeRecurrence(schedule),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Course != b.Course {
+			return a.Course < b.Course
+		}
+		if a.StartDate != b.StartDate {
+			return a.StartDate < b.StartDate
+		}
+		return a.StartTime < b.StartTime
+	})
+
+	return result
+}
+
+// classifyCheckIn tags a check-in against the sessions scheduled on its day.
+// It returns on-time if the check-in falls between the opening of a session and the end of its grace period,
+// late if it falls after the grace period but before the session ends, and outside-session otherwise.
+// The ID of the matched schedule is returned along with the status, on-time matches taking precedence over late ones.
+// If courseID is not empty, only the sessions of that course are considered.
+func classifyCheckIn(now time.Time, courseID string) (string, string) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	status, scheduleID := states.StatusOutsideSession, ""
+
+	for _, details := range scheduleList() {
+		schedule := details.Schedule
+		if courseID != "" && schedule.CourseID != courseID {
+			continue
+		}
+		if !scheduleOccursOn(schedule, today) {
+			continue
+		}
+		start, end, err := scheduleWindow(schedule, today)
+		if err != nil {
+			logger.Println(err)
+			continue
+		}
+
+		grace := time.Duration(schedule.GraceMinutes) * time.Minute
+		switch {
+		case now.Before(start.Add(-checkInOpensBefore)) || now.After(end):
+			continue
+		case !now.After(start.Add(grace)):
+			return states.StatusOnTime, schedule.ID
+		case status != states.StatusLate:
+			status, scheduleID = states.StatusLate, schedule.ID
+		}
+	}
+
+	return status, scheduleID
+}
+
+// validateSchedule checks that the dates, times, grace period and recurrence rule of a schedule are well-formed.
+func validateSchedule(schedule states.Schedule) error {
+	if schedule.Course == "" {
+		return errors.New("Course is required")
+	}
+	if _, err := time.ParseInLocation("2006-01-02", schedule.StartDate, time.Local); err != nil {
+		return errors.New("Start date must be a valid date")
+	}
+	start, end, err := scheduleWindow(schedule, time.Now())
+	if err != nil {
+		return errors.New("Start and end times must be valid times of day")
+	}
+	if !end.After(start) {
+		return errors.New("End time must be after start time")
+	}
+	if schedule.GraceMinutes < 0 {
+		return errors.New("Grace period cannot be negative")
+	}
+	if _, err := parseRecurrence(schedule.Recurrence); err != nil {
+		return err
+	}
+	return nil
+}
+
+// scheduleOccursOn reports whether the schedule has a session on the given date.
+func scheduleOccursOn(schedule states.Schedule, date time.Time) bool {
+	startDate, err := time.ParseInLocation("2006-01-02", schedule.StartDate, date.Location())
+	if err != nil {
+		return false
+	}
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	if date.Before(startDate) {
+		return false
+	}
+
+	rec, err := parseRecurrence(schedule.Recurrence)
+	if err != nil {
+		logger.Println(err)
+		return false
+	}
+	if rec.freq == "" {
+		return date.Equal(startDate)
+	}
+	if !rec.until.IsZero() && date.After(rec.until) {
+		return false
+	}
+
+	days := rec.days
+	if rec.freq == freqWeekly && len(days) == 0 {
+		days = map[time.Weekday]bool{startDate.Weekday(): true}
+	}
+	if len(days) > 0 {
+		return days[date.Weekday()]
+	}
+	return true
+}
+
+// scheduleWindow returns the start and end times of the schedule's session on the given date.
+func scheduleWindow(schedule states.Schedule, date time.Time) (time.Time, time.Time, error) {
+	startTime, err := time.Parse("15:04", schedule.StartTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start time of schedule %s: %w", schedule.ID, err)
+	}
+	endTime, err := time.Parse("15:04", schedule.EndTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end time of schedule %s: %w", schedule.ID, err)
+	}
+
+	start := time.Date(date.Year(), date.Month(), date.Day(), startTime.Hour(), startTime.Minute(), 0, 0, date.Location())
+	end := time.Date(date.Year(), date.Month(), date.Day(), endTime.Hour(), endTime.Minute(), 0, 0, date.Location())
+	return start, end, nil
+}
+
+// buildRecurrence builds a recurrence rule from the schedule form.
+// The frequency is one of "once", "daily" or "weekly", days are BYDAY codes and until an optional "2006-01-02" date.
+func buildRecurrence(frequency string, days []string, until string) (string, error) {
+	parts := []string{}
+	switch frequency {
+	case "", "once":
+		return "", nil
+	case "daily":
+		parts = append(parts, "FREQ="+freqDaily)
+	case "weekly":
+		parts = append(parts, "FREQ="+freqWeekly)
+	default:
+		return "", fmt.Errorf("Unknown frequency %q", frequency)
+	}
+
+	if len(days) > 0 {
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if until != "" {
+		parts = append(parts, "UNTIL="+until)
+	}
+
+	rule := strings.Join(parts, ";")
+	if _, err := parseRecurrence(rule); err != nil {
+		return "", err
+	}
+	return rule, nil
+}
+
+// parseRecurrence parses the supported subset of RRULE: FREQ (DAILY or WEEKLY), BYDAY and UNTIL (as "2006-01-02").
+// An empty rule is valid and describes a one-off session.
+func parseRecurrence(rule string) (recurrence, error) {
+	rec := recurrence{}
+	if rule == "" {
+		return rec, nil
+	}
+
+	for _, part := range strings.Split(rule, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return rec, fmt.Errorf("Invalid recurrence rule %q", rule)
+		}
+
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rec.freq = strings.ToUpper(value)
+			if rec.freq != freqDaily && rec.freq != freqWeekly {
+				return rec, fmt.Errorf("Unsupported recurrence frequency %q", value)
+			}
+		case "BYDAY":
+			rec.days = map[time.Weekday]bool{}
+			for _, code := range strings.Split(value, ",") {
+				day, ok := weekdayFromCode(code)
+				if !ok {
+					return rec, fmt.Errorf("Unknown recurrence day %q", code)
+				}
+				rec.days[day] = true
+			}
+		case "UNTIL":
+			until, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return rec, fmt.Errorf("Invalid recurrence end date %q", value)
+			}
+			rec.until = until
+		default:
+			return rec, fmt.Errorf("Unsupported recurrence rule part %q", key)
+		}
+	}
+
+	if rec.freq == "" {
+		return rec, fmt.Errorf("Recurrence rule %q has no frequency", rule)
+	}
+	return rec, nil
+}
+
+// describeRecurrence summarizes when a schedule occurs, e.g. "Weekly on MO, WE from 2024-01-08 until 2024-03-01".
+func describeRecurrence(schedule states.Schedule) string {
+	rec, err := parseRecurrence(schedule.Recurrence)
+	if err != nil {
+		return schedule.Recurrence
+	}
+	if rec.freq == "" {
+		return "Once on " + schedule.StartDate
+	}
+
+	summary := "Daily"
+	if rec.freq == freqWeekly {
+		summary = "Weekly"
+	}
+	if len(rec.days) > 0 {
+		codes := []string{}
+		for _, weekday := range weekdayCodes {
+			if rec.days[weekday.Day] {
+				codes = append(codes, weekday.Code)
+			}
+		}
+		summary += " on " + strings.Join(codes, ", ")
+	}
+	summary += " from " + schedule.StartDate
+	if !rec.until.IsZero() {
+		summary += " until " + rec.until.Format("2006-01-02")
+	}
+	return summary
+}
+
+// weekdayFromCode returns the weekday of a BYDAY code such as "MO".
+func weekdayFromCode(code string) (time.Weekday, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, weekday := range weekdayCodes {
+		if weekday.Code == code {
+			return weekday.Day, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+)
+
+// Actions recorded in the audit log for admin accounts created or recovered outside of the web interface
+const (
+	auditAdminCreated  = "admin-created"
+	auditAdminPassword = "admin-password-set"
+)
+
+// defaultAdminID is the login ID of the admin account created from ADMIN_PASSWORD on first run
+const defaultAdminID = "admin"
+
+// adminCommandUsage describes the admin commands run by AdminCommand
+const adminCommandUsage = `usage:
+  attendance admin create <loginID> [first] [last]   create an admin account
+  attendance admin password <loginID>                set the password of an account
+
+The password is read from the first line of stdin. Run admin commands while the server is stopped.`
+
+// BootstrapAdmin makes sure an admin account can log in before the server starts.
+// On first run, when no admin has a password yet, the "admin" account is created with ADMIN_PASSWORD,
+// which must follow the password policy. Once an admin exists, ADMIN_PASSWORD is ignored and admin credentials
+// are only changed through the application or the admin commands.
+func BootstrapAdmin() error {
+	if adminExists() {
+		if os.Getenv("ADMIN_PASSWORD") != "" {
+			logger.Println("ADMIN_PASSWORD is ignored, an admin account already exists")
+		}
+		return nil
+	}
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		return errors.New("no admin account exists, set ADMIN_PASSWORD to create one on first run, or run `attendance admin create <loginID>`")
+	}
+	if err := createAdmin(defaultAdminID, "admin", "admin", password); err != nil {
+		return fmt.Errorf("creating admin account from ADMIN_PASSWORD: %w", err)
+	}
+	logger.Println(fmt.Sprintf("Created admin account %q from ADMIN_PASSWORD, which can now be removed from the env", defaultAdminID))
+	return nil
+}
+
+// AdminCommand runs the admin command of the command line arguments, reading the password from stdin.
+func AdminCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) < 3 || args[0] != "admin" {
+		return errors.New(adminCommandUsage)
+	}
+	loginID := strings.TrimSpace(args[2])
+
+	switch {
+	case args[1] == "create" && len(args) <= 5:
+		first, last := "admin", "admin"
+		if len(args) > 3 {
+			first = args[3]
+		}
+		if len(args) > 4 {
+			last = args[4]
+		}
+		password, err := readPassword(stdin, stdout)
+		if err != nil {
+			return err
+		}
+		if err := createAdmin(loginID, first, last, password); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Created admin account %q\n", loginID)
+	case args[1] == "password" && len(args) == 3:
+		user, ok := states.GetMapUser(loginID)
+		if !ok {
+			return fmt.Errorf("user %q not found", loginID)
+		}
+		password, err := readPassword(stdin, stdout)
+		if err != nil {
+			return err
+		}
+		if err := setPassword(user, password, ""); err != nil {
+			return err
+		}
+		recordAudit("", auditAdminPassword, loginID, "Password set through the admin command")
+		fmt.Fprintf(stdout, "Set the password of %q, ending their sessions\n", loginID)
+	default:
+		return errors.New(adminCommandUsage)
+	}
+	return nil
+}
+
+// adminExists reports whether an admin account with a password exists.
+func adminExists() bool {
+	for _, user := range states.GetAllMapUsers() {
+		if user.Role == states.RoleAdmin && len(user.Password) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// createAdmin creates an admin account with a password following the password policy.
+// An existing account is never overwritten, so that persisted credentials are kept.
+func createAdmin(loginID string, first string, last string, password string) error {
+	if loginID == "" {
+		return errors.New("login ID is required")
+	}
+	if _, ok := states.GetMapUser(loginID); ok {
+		return fmt.Errorf("user %q already exists, assign them the admin role at /admin/users or set their password with `attendance admin password`", loginID)
+	}
+	if err := validatePassword(loginID, password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	admin := states.User{
+		ID:       loginID,
+		Password: hash,
+		First:    first,
+		Last:     last,
+		Role:     states.RoleAdmin,
+	}
+	if err := states.SetMapUser(loginID, admin); err != nil {
+		return fmt.Errorf("saving admin account: %w", err)
+	}
+	recordAudit("", auditAdminCreated, loginID, "Admin account created outside of the application")
+	return nil
+}
+
+// readPassword prompts for a password and reads it from the first line of stdin.
+func readPassword(stdin io.Reader, stdout io.Writer) (string, error) {
+	fmt.Fprint(stdout, "Password: ")
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("no password given on stdin")
+	}
+	fmt.Fprintln(stdout)
+	return strings.TrimRight(line, "\r\n"), nil
+}
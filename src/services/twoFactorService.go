@@ -0,0 +1,412 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"attendance.com/src/logger"
+	"attendance.com/src/states"
+	"attendance.com/src/totp"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Actions recorded in the audit log for two-factor authentication
+const (
+	auditTwoFactorEnabled  = "2fa-enabled"
+	auditTwoFactorDisabled = "2fa-disabled"
+	auditTwoFactorReset    = "2fa-reset"
+	auditRecoveryCodeUsed  = "2fa-recovery-code-used"
+)
+
+// Two-factor authentication settings
+const (
+	// recoveryCodeCount is the number of recovery codes generated at once
+	recoveryCodeCount = 10
+	// twoFactorEnrollmentTTL is how long a secret shown on the enrollment page can be confirmed
+	twoFactorEnrollmentTTL = 10 * time.Minute
+	// twoFactorLoginTTL is how long a login whose password matched waits for its two-factor code
+	twoFactorLoginTTL = 5 * time.Minute
+)
+
+// TwoFactorPageVariables struct represents the variables that are passed to the two-factor authentication page template
+// On the enrollment page, QRCode is the PNG of the provisioning URI of Secret as a data URL.
+// RecoveryCodes are only set right after they were generated, as they are never shown again.
+type TwoFactorPageVariables struct {
+	User          states.User
+	Tab           string
+	Eligible      bool
+	Enrolled      bool
+	QRCode        template.URL
+	Secret        string
+	RecoveryCodes []string
+	RecoveryLeft  int
+}
+
+// pendingSecret struct represents a secret shown on the enrollment page, waiting to be confirmed with a code
+type pendingSecret struct {
+	Secret    string
+	ExpiresAt time.Time
+}
+
+// twoFactorLogin struct represents a login whose password matched, waiting for its two-factor code
+type twoFactorLogin struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+var (
+	// totpIssuer names the application in authenticator apps (TOTP_ISSUER)
+	totpIssuer string
+
+	twoFactorMu sync.Mutex
+	// pendingSecrets maps user IDs to the secret they are enrolling
+	pendingSecrets = map[string]pendingSecret{}
+	// twoFactorLogins maps the SHA-256 of two-factor login tokens to their login
+	twoFactorLogins = map[string]twoFactorLogin{}
+)
+
+func init() {
+	if totpIssuer = os.Getenv("TOTP_ISSUER"); totpIssuer == "" {
+		totpIssuer = "Attendance"
+	}
+}
+
+// twoFactorEligible reports whether a user can enroll in two-factor authentication, which is offered to every role but students.
+func twoFactorEligible(user states.User) bool {
+	return user.Role != states.RoleStudent
+}
+
+// TwoFactorPage renders the two-factor authentication page.
+// The "verify" tab asks for the code of a pending login, and the "2fa" tab lets logged in users enroll or manage their enrollment.
+func (a *AuthService) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	variables := TwoFactorPageVariables{Tab: strings.Split(r.URL.Path, "/")[len(strings.Split(r.URL.Path, "/"))-1]}
+
+	if variables.Tab == "verify" {
+		if _, ok := pendingTwoFactorLogin(r, time.Now()); !ok {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		renderTwoFactorPage(w, r, variables)
+		return
+	}
+
+	variables.User = a.GetUser(r)
+	if variables.User.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	variables.Eligible = twoFactorEligible(variables.User)
+	variables.Enrolled = variables.User.TOTPSecret != ""
+	variables.RecoveryLeft = len(variables.User.RecoveryCodes)
+
+	if variables.Eligible && !variables.Enrolled {
+		secret, err := totp.NewSecret()
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "Error generating secret", http.StatusInternalServerError)
+			return
+		}
+		png, err := qrcode.Encode(totp.URI(totpIssuer, variables.User.ID, secret), qrcode.Medium, 256)
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "Error generating QR code", http.StatusInternalServerError)
+			return
+		}
+
+		twoFactorMu.Lock()
+		pendingSecrets[variables.User.ID] = pendingSecret{Secret: secret, ExpiresAt: time.Now().Add(twoFactorEnrollmentTTL)}
+		twoFactorMu.Unlock()
+
+		variables.Secret = secret
+		variables.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	renderTwoFactorPage(w, r, variables)
+}
+
+// EnableTwoFactor handles the form submission confirming the enrollment of the logged in user with the "code" form value,
+// generated from the secret last shown on the enrollment page. The recovery codes are shown once enrolled.
+func (a *AuthService) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	currUser := a.GetUser(r)
+	if currUser.ID == "" || !twoFactorEligible(currUser) {
+		http.Error(w, "Two-factor authentication is not available for your account", http.StatusForbidden)
+		return
+	}
+	if currUser.TOTPSecret != "" {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	twoFactorMu.Lock()
+	pending, ok := pendingSecrets[currUser.ID]
+	twoFactorMu.Unlock()
+	if !ok || now.After(pending.ExpiresAt) {
+		http.Error(w, "The enrollment has expired, reload the page and scan the new QR code.", http.StatusBadRequest)
+		return
+	}
+	step, ok := totp.Validate(pending.Secret, r.FormValue("code"), now, 0)
+	if !ok {
+		http.Error(w, "Code does not match, check the time of your device and try again.", http.StatusForbidden)
+		return
+	}
+
+	codes := newRecoveryCodes()
+	currUser.TOTPSecret, currUser.TOTPLastStep = pending.Secret, step
+	currUser.RecoveryCodes = hashRecoveryCodes(codes)
+	if err := states.SetMapUser(currUser.ID, currUser); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	twoFactorMu.Lock()
+	delete(pendingSecrets, currUser.ID)
+	twoFactorMu.Unlock()
+	recordAudit(currUser.ID, auditTwoFactorEnabled, currUser.ID, "Two-factor authentication enabled")
+
+	renderTwoFactorPage(w, r, TwoFactorPageVariables{User: currUser, Tab: "codes", Eligible: true, Enrolled: true, RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes handles the form submission replacing the recovery codes of the logged in user,
+// once the "code" form value is checked. The new recovery codes are shown once.
+func (a *AuthService) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	currUser := a.GetUser(r)
+	if currUser.ID == "" || currUser.TOTPSecret == "" {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	currUser, err := checkSecondFactor(currUser, r.FormValue("code"), clientAddr(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	codes := newRecoveryCodes()
+	currUser.RecoveryCodes = hashRecoveryCodes(codes)
+	if err := states.SetMapUser(currUser.ID, currUser); err != nil {
+		logger.Println(err)
+		http.Error(w, "Error saving recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	renderTwoFactorPage(w, r, TwoFactorPageVariables{User: currUser, Tab: "codes", Eligible: true, Enrolled: true, RecoveryCodes: codes})
+}
+
+// DisableTwoFactor handles the form submission of the logged in user turning off two-factor authentication,
+// which requires their "password" along with a "code" of the authenticator app or a recovery code, both counting as login attempts.
+func (a *AuthService) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	currUser := a.GetUser(r)
+	if currUser.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	addr := clientAddr(r)
+	if err := checkCurrentPassword(currUser, r.FormValue("password"), addr); err != nil {
+		writeError(w, err)
+		return
+	}
+	user, err := checkSecondFactor(currUser, r.FormValue("code"), addr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := clearTwoFactor(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAudit(currUser.ID, auditTwoFactorDisabled, currUser.ID, "Two-factor authentication disabled by the user")
+
+	http.Redirect(w, r, "/auth/2fa", http.StatusSeeOther)
+}
+
+// VerifyTwoFactor handles the form submission of the two-factor code of a pending login.
+// The "code" form value is either a code of the authenticator app or an unused recovery code.
+// Once it matches, the session of the user is started.
+func (a *AuthService) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	login, ok := pendingTwoFactorLogin(r, time.Now())
+	if !ok {
+		http.Error(w, "The login has expired, sign in again.", http.StatusForbidden)
+		return
+	}
+	user, ok := states.GetMapUser(login.UserID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := checkSecondFactor(user, r.FormValue("code"), clientAddr(r)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	twoFactorCookie, _ := r.Cookie(twoFactorCookieName)
+	twoFactorMu.Lock()
+	delete(twoFactorLogins, hashToken(twoFactorCookie.Value))
+	twoFactorMu.Unlock()
+	http.SetCookie(w, newCookie(r, twoFactorCookieName, "", -1))
+
+	sessionID, _, err := a.StartSession(user.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setSessCookie(w, r, sessionID)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ResetTwoFactor handles the HTTP request to turn off two-factor authentication for the "user" form value,
+// for users who lost their device and their recovery codes. Users cannot reset their own two-factor authentication.
+func (p *AdminService) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := r.FormValue("user")
+	currUser := Auth.GetUser(r)
+	if userID == currUser.ID {
+		http.Error(w, "You cannot reset your own two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	user, ok := states.GetMapUser(userID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := clearTwoFactor(user); err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAudit(currUser.ID, auditTwoFactorReset, userID, "Two-factor authentication reset, the user can enroll again")
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// startTwoFactorLogin sets the cookie of a login whose password matched, which the code of the verify page completes.
+func startTwoFactorLogin(w http.ResponseWriter, r *http.Request, userID string) {
+	token := randomToken()
+	now := time.Now()
+
+	twoFactorMu.Lock()
+	for key, login := range twoFactorLogins {
+		if now.After(login.ExpiresAt) {
+			delete(twoFactorLogins, key)
+		}
+	}
+	twoFactorLogins[hashToken(token)] = twoFactorLogin{UserID: userID, ExpiresAt: now.Add(twoFactorLoginTTL)}
+	twoFactorMu.Unlock()
+
+	http.SetCookie(w, newCookie(r, twoFactorCookieName, token, int(twoFactorLoginTTL.Seconds())))
+}
+
+// pendingTwoFactorLogin returns the login of the two-factor cookie of the request, if it has not expired.
+func pendingTwoFactorLogin(r *http.Request, now time.Time) (twoFactorLogin, bool) {
+	twoFactorCookie, err := r.Cookie(twoFactorCookieName)
+	if err != nil {
+		return twoFactorLogin{}, false
+	}
+
+	twoFactorMu.Lock()
+	defer twoFactorMu.Unlock()
+
+	login, ok := twoFactorLogins[hashToken(twoFactorCookie.Value)]
+	if !ok || now.After(login.ExpiresAt) {
+		return twoFactorLogin{}, false
+	}
+	return login, true
+}
+
+// checkSecondFactor checks a code of the authenticator app or a recovery code of a user enrolled in two-factor authentication.
+// The matched code is used up and the user returned as saved. Wrong codes count as failed logins.
+func checkSecondFactor(user states.User, code string, addr string) (states.User, error) {
+	now := time.Now()
+	if remaining := logins.lockedFor(user.ID, addr, now); remaining > 0 {
+		return user, lockedOutError(remaining)
+	}
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, now, user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+	} else if i := recoveryCodeIndex(user.RecoveryCodes, code); i >= 0 {
+		user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+		recordAudit(user.ID, auditRecoveryCodeUsed, user.ID, "Recovery code used to log in")
+	} else {
+		logins.fail(user.ID, addr, now)
+		return user, newServiceError(http.StatusForbidden, "Two-factor code does not match")
+	}
+
+	if err := states.SetMapUser(user.ID, user); err != nil {
+		logger.Println(err)
+		return user, newServiceError(http.StatusInternalServerError, "Error saving two-factor authentication")
+	}
+	logins.succeed(user.ID)
+	return user, nil
+}
+
+// clearTwoFactor turns off two-factor authentication for a user.
+func clearTwoFactor(user states.User) error {
+	user.TOTPSecret, user.TOTPLastStep, user.RecoveryCodes = "", 0, nil
+	if err := states.SetMapUser(user.ID, user); err != nil {
+		logger.Println(err)
+		return newServiceError(http.StatusInternalServerError, "Error saving two-factor authentication")
+	}
+	return nil
+}
+
+// newRecoveryCodes returns a new set of recovery codes, formatted as two groups of 5 hex characters.
+func newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 5)
+		if _, err := io.ReadFull(rand.Reader, random); err != nil {
+			log.Fatalln("error generating recovery code::" + err.Error())
+		}
+		code := hex.EncodeToString(random)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes
+}
+
+// hashRecoveryCodes returns the hashes the recovery codes are kept as.
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+	return hashes
+}
+
+// recoveryCodeIndex returns the index of the hash of a recovery code, or -1 if it is not one of the unused codes.
+func recoveryCodeIndex(hashes []string, code string) int {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return -1
+	}
+	for i, hash := range hashes {
+		if matchesHash(code, hash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeRecoveryCode lowercases a recovery code and strips its separators, so that it can be typed either way.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// renderTwoFactorPage renders the two-factor authentication page template.
+func renderTwoFactorPage(w http.ResponseWriter, r *http.Request, variables TwoFactorPageVariables) {
+	if err := renderTemplate(w, r, "twoFactorPage", variables); err != nil {
+		logger.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
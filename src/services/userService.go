@@ -5,11 +5,9 @@ import (
 	"sync"
 	"time"
 
-	"attendance.com/src/db"
 	"attendance.com/src/logger"
 	"attendance.com/src/states"
 	"attendance.com/src/templates"
-	utils "attendance.com/src/util"
 )
 
 // UserPageVariables struct represents the variables used in the user page.
@@ -30,8 +28,7 @@ var (
 )
 
 // CheckIn handles the check-in process for a user.
-// It guards if the user is already checked in, and if they are on the appropriate WIFI.
-// It then updates the attendance.json file and redirects to the success page.
+// It guards if the user is on the WIFI of one of the locations, then records the attendance along with the matched location.
 // If any error occurs during the check-in process, it recovers from the panic and redirects to the home page.
 func (u *UserService) CheckIn(w http.ResponseWriter, r *http.Request) {
 	// isCheckedIn potentially panics
@@ -49,36 +46,118 @@ func (u *UserService) CheckIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user is already checked in
-	if templates.IsCheckedIn(currUser.ID) != "" {
-		http.Error(w, "You are already checked in", http.StatusForbidden)
+	location, err := networkLocation(r, "check-in")
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// Check if user is on appropriate WIFI
-	ok, err := utils.ValidateClientIPHandler(r)
-	if !ok || err != nil {
-		logger.Println(err)
-		http.Error(w, "Unable to check-in. You are not on the appropriate WIFI.", http.StatusForbidden)
+	if _, err := u.RecordCheckIn(currUser.ID, location, r.FormValue("course")); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// Update attendance.json
-	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	if _, ok := states.GetMapAttendanceOuter(today); !ok {
-		states.SetMapAttendanceOuter(today, map[string]time.Time{})
+	http.Redirect(w, r, "/user/attendance/success", http.StatusFound)
+}
+
+// RecordCheckIn records the check-in of a user at a location and returns the attendance record.
+// It guards if the user is deactivated or already checked in, and if the user is enrolled in the course checked in for.
+// The check-in is dated and tagged against the sessions scheduled today in the time zone of the location.
+func (u *UserService) RecordCheckIn(userID string, location states.Location, courseID string) (states.Attendance, error) {
+	if user, ok := states.GetMapUser(userID); ok && user.Deactivated {
+		return states.Attendance{}, deactivatedError()
+	}
+
+	// Check if user is already checked in
+	if templates.IsCheckedIn(userID) != "" {
+		return states.Attendance{}, newServiceError(http.StatusForbidden, "You are already checked in")
 	}
-	states.SetMapAttendanceInner(today, currUser.ID, now)
 
-	// Write MapAttendance state to database
-	// Can potentially panic here if the database is not writable
-	err = db.Write(states.GetAllMapAttendanceOuter(), "attendance.json")
+	courseID, err := checkInCourse(userID, courseID)
 	if err != nil {
+		return states.Attendance{}, err
+	}
+
+	now := time.Now().In(locationTimezone(location))
+	today := states.AttendanceDate(now)
+	status, scheduleID := classifyCheckIn(now, courseID)
+	record := states.Attendance{
+		CheckIn:    now,
+		Status:     status,
+		ScheduleID: scheduleID,
+		LocationID: location.ID,
+		CourseID:   courseID,
+	}
+	if err := states.SetMapAttendanceInner(today, userID, record); err != nil {
 		logger.Println(err)
+		return states.Attendance{}, newServiceError(http.StatusInternalServerError, "Unable to check-in. Please try again.")
 	}
 
-	http.Redirect(w, r, "/user/attendance/success", http.StatusFound)
+	return record, nil
+}
+
+// CheckOut handles the check-out process for a user.
+// It guards if the user is on the WIFI of one of the locations, then records the check-out time and redirects to the success page.
+func (u *UserService) CheckOut(w http.ResponseWriter, r *http.Request) {
+	currUser := Auth.GetUser(r)
+	if currUser.ID == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	location, err := networkLocation(r, "check-out")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := u.RecordCheckOut(currUser.ID, location); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/attendance/checkout/success", http.StatusFound)
+}
+
+// RecordCheckOut records the check-out time of a user at a location and returns the updated attendance record.
+// It guards if the user has checked in today and has not yet checked out.
+func (u *UserService) RecordCheckOut(userID string, location states.Location) (states.Attendance, error) {
+	now := time.Now().In(locationTimezone(location))
+	today := states.AttendanceDate(now)
+	record, ok := states.GetMapAttendanceInner(today, userID)
+	if !ok {
+		return states.Attendance{}, newServiceError(http.StatusForbidden, "You have not checked in today")
+	}
+	if record.IsCheckedOut() {
+		return states.Attendance{}, newServiceError(http.StatusForbidden, "You are already checked out")
+	}
+
+	record.CheckOut = now
+	if err := states.SetMapAttendanceInner(today, userID, record); err != nil {
+		logger.Println(err)
+		return states.Attendance{}, newServiceError(http.StatusInternalServerError, "Unable to check-out. Please try again.")
+	}
+
+	return record, nil
+}
+
+// networkLocation returns the location whose WIFI the request was sent from, or an error naming the action that was refused.
+func networkLocation(r *http.Request, action string) (states.Location, error) {
+	// Check if user is on the WIFI of one of the locations
+	location, ok, err := matchLocation(r)
+	if !ok || err != nil {
+		if err != nil {
+			logger.Println(err)
+		}
+		return states.Location{}, newServiceError(http.StatusForbidden, "Unable to "+action+". You are not on the appropriate WIFI.")
+	}
+	return location, nil
+}
+
+// CheckOutSuccess redirects the user to the home page with the "attendanceSuccess" form value set to "checkout".
+// This is used to display a success message on the home page.
+func (u *UserService) CheckOutSuccess(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/?attendanceSuccess=checkout", http.StatusFound)
 }
 
 // CheckInSuccess redirects the user to the home page with the "attendanceSuccess" form value set to "success".
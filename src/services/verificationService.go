@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"attendance.com/src/notify"
+	"attendance.com/src/states"
+	utils "attendance.com/src/util"
+)
+
+// verificationCodeDigits is the length of the verification codes emailed to users who register
+const verificationCodeDigits = 8
+
+// emailedCode struct represents a pending verification code emailed to a user who registers
+type emailedCode struct {
+	Hash      string
+	ExpiresAt time.Time
+}
+
+var (
+	// verificationCodeTTL is how long an emailed verification code remains valid (VERIFICATION_CODE_TTL)
+	verificationCodeTTL time.Duration
+
+	emailedCodesMu sync.Mutex
+	// emailedCodes maps user IDs to the SHA-256 of the verification code last emailed to them
+	emailedCodes = map[string]emailedCode{}
+)
+
+func init() {
+	verificationCodeTTL = utils.GetEnvDuration("VERIFICATION_CODE_TTL", 15*time.Minute)
+}
+
+// SendVerificationCode handles the form submission of a user asking for a verification code to register with.
+// A code is emailed through the notifier to the unregistered user of the "loginID" form value, if the student list gave them an email.
+// Codes are throttled per user and per client address, and sent in the background.
+// The same page is shown whether or not a code was sent, so that login IDs and emails cannot be probed.
+func (a *AuthService) SendVerificationCode(w http.ResponseWriter, r *http.Request) {
+	user, ok := states.GetMapUser(r.FormValue("loginID"))
+	now := time.Now()
+	if ok && len(user.Password) == 0 && user.Email != "" && !user.Deactivated && emails.allow(user.ID, clientAddr(r), now) {
+		code := issueEmailedCode(user.ID, now)
+		message := notify.Message{
+			UserID:  user.ID,
+			Email:   user.Email,
+			Subject: "Your registration code",
+			Body: fmt.Sprintf("Enter the code %s along with your login ID to register.\nThe code expires in %s.",
+				code, verificationCodeTTL),
+		}
+		sendEmail(message)
+	}
+
+	http.Redirect(w, r, "/auth/register/code", http.StatusSeeOther)
+}
+
+// verifyRegistration checks the verification code submitted by a user who registers from the client address.
+// Users the student list gave neither an enrollment code nor an email register without one.
+// Otherwise the code must match the enrollment code, or the last code emailed to the user.
+// Wrong codes count as failed logins, so that guessing codes is locked out like guessing passwords.
+func verifyRegistration(user states.User, code string, addr string) error {
+	if user.EnrollmentCode == "" && user.Email == "" {
+		return nil
+	}
+
+	now := time.Now()
+	if remaining := logins.lockedFor(user.ID, addr, now); remaining > 0 {
+		return lockedOutError(remaining)
+	}
+	if code != "" && (matchesHash(code, user.EnrollmentCode) || consumeEmailedCode(user.ID, code, now)) {
+		return nil
+	}
+
+	logins.fail(user.ID, addr, now)
+	if user.EnrollmentCode == "" {
+		return newServiceError(http.StatusForbidden, "Verification code does not match, request a code to be emailed to you.")
+	}
+	return newServiceError(http.StatusForbidden, "Verification code does not match.")
+}
+
+// issueEmailedCode returns a new verification code for the user, replacing any pending one.
+func issueEmailedCode(userID string, now time.Time) string {
+	code := randomDigits(verificationCodeDigits)
+
+	emailedCodesMu.Lock()
+	defer emailedCodesMu.Unlock()
+
+	for id, pending := range emailedCodes {
+		if now.After(pending.ExpiresAt) {
+			delete(emailedCodes, id)
+		}
+	}
+	emailedCodes[userID] = emailedCode{Hash: hashToken(code), ExpiresAt: now.Add(verificationCodeTTL)}
+	return code
+}
+
+// consumeEmailedCode reports whether the code matches the pending code emailed to the user, and invalidates it if it does.
+func consumeEmailedCode(userID string, code string, now time.Time) bool {
+	emailedCodesMu.Lock()
+	defer emailedCodesMu.Unlock()
+
+	pending, ok := emailedCodes[userID]
+	if !ok || now.After(pending.ExpiresAt) || !matchesHash(code, pending.Hash) {
+		return false
+	}
+	delete(emailedCodes, userID)
+	return true
+}
+
+// cancelEmailedCode invalidates the pending code emailed to a user.
+func cancelEmailedCode(userID string) {
+	emailedCodesMu.Lock()
+	defer emailedCodesMu.Unlock()
+
+	delete(emailedCodes, userID)
+}
+
+// matchesHash reports whether the SHA-256 of a code is the given hash, in constant time.
+func matchesHash(code string, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(hashToken(strings.TrimSpace(code))), []byte(hash)) == 1
+}
+
+// randomDigits returns a random code of n decimal digits.
+func randomDigits(n int) string {
+	digits := make([]byte, n)
+	for i := range digits {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			log.Fatalln("error generating random code::" + err.Error())
+		}
+		digits[i] = byte('0' + digit.Int64())
+	}
+	return string(digits)
+}
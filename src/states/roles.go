@@ -0,0 +1,77 @@
+package states
+
+import "attendance.com/src/db"
+
+// Roles a user can be assigned
+const (
+	RoleStudent    = db.RoleStudent
+	RoleInstructor = db.RoleInstructor
+	RoleAdmin      = db.RoleAdmin
+	RoleAuditor    = db.RoleAuditor
+)
+
+// Roles lists every role, in the order they are displayed
+var Roles = []string{RoleStudent, RoleInstructor, RoleAuditor, RoleAdmin}
+
+// Permission is an action that is granted to roles
+type Permission string
+
+// Permissions checked by the router, the API and the templates
+const (
+	// PermCheckIn allows checking in and out
+	PermCheckIn Permission = "check-in"
+	// PermViewAttendance allows viewing and exporting the attendance overview of the courses the user owns
+	PermViewAttendance Permission = "view-attendance"
+	// PermViewAllAttendance lifts the restriction of PermViewAttendance to owned courses
+	PermViewAllAttendance Permission = "view-all-attendance"
+	// PermRunKiosk allows displaying the check-in kiosk
+	PermRunKiosk Permission = "run-kiosk"
+	// PermManageUsers allows uploading student lists and assigning roles
+	PermManageUsers Permission = "manage-users"
+	// PermManageSchedules allows creating and deleting class schedules
+	PermManageSchedules Permission = "manage-schedules"
+	// PermManageLocations allows creating and deleting locations
+	PermManageLocations Permission = "manage-locations"
+	// PermManageCourses allows creating and deleting courses
+	PermManageCourses Permission = "manage-courses"
+	// PermViewAudit allows viewing the audit log
+	PermViewAudit Permission = "view-audit"
+	// PermManageSessions allows listing and revoking sessions
+	PermManageSessions Permission = "manage-sessions"
+)
+
+// rolePermissions maps each role to the permissions it is granted
+var rolePermissions = map[string][]Permission{
+	RoleStudent:    {PermCheckIn},
+	RoleInstructor: {PermCheckIn, PermViewAttendance, PermRunKiosk},
+	RoleAuditor:    {PermViewAttendance, PermViewAllAttendance, PermViewAudit},
+	RoleAdmin: {
+		PermViewAttendance, PermViewAllAttendance, PermRunKiosk, PermManageUsers,
+		PermManageSchedules, PermManageLocations, PermManageCourses, PermManageSessions, PermViewAudit,
+	},
+}
+
+// Can reports whether the role of the user grants the permission.
+func Can(user User, permission Permission) bool {
+	for _, granted := range rolePermissions[user.Role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidRole reports whether role is one of the known roles.
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// legacyRole returns the role of a user persisted before roles were introduced,
+// where the "admin" ID was the only administrator and every other user a student.
+func legacyRole(userID string) string {
+	if userID == "admin" {
+		return RoleAdmin
+	}
+	return RoleStudent
+}
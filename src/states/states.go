@@ -1,7 +1,10 @@
 package states
 
 import (
+	"errors"
+	"io/fs"
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -11,26 +14,72 @@ import (
 )
 
 // User struct represents the metadata of an authenticated user
-type User struct {
-	ID       string
-	Password []byte
-	First    string
-	Last     string
-}
+type User = db.User
+
+// Session struct represents a login session along with its creation and last-seen times
+type Session = db.Session
+
+// Attendance struct represents the check-in and check-out times of a user on a given date
+type Attendance = db.Attendance
+
+// Schedule struct represents a scheduled class session
+type Schedule = db.Schedule
+
+// Location struct represents a campus or site along with its networks and timezone
+type Location = db.Location
+
+// Course struct represents a class that students are enrolled in
+type Course = db.Course
+
+// Enrollment struct represents a user enrolled in a course
+type Enrollment = db.Enrollment
+
+// AuditEntry struct represents a security-relevant event, such as an account being locked out
+type AuditEntry = db.AuditEntry
+
+// Attendance statuses assigned at check-in
+const (
+	StatusOnTime         = db.StatusOnTime
+	StatusLate           = db.StatusLate
+	StatusOutsideSession = db.StatusOutsideSession
+)
 
 // Variables that holds all user and session details
 var (
+	// store persists every change made through the setters
+	store db.Store
+
 	MapUsersMutex sync.Mutex
 	// MapUsers is a map of user IDs to User structs
 	MapUsers = map[string]User{}
 
 	MapSessionsMutex sync.Mutex
-	// MapSessions is a map of session IDs to user IDs
-	MapSessions = map[string]string{}
+	// MapSessions is a map of session IDs to sessions
+	MapSessions = map[string]Session{}
 
 	MapAttendanceMutex sync.Mutex
-	// MapAttendance is a map of dateTimes to a map of user IDs to check-in times
-	MapAttendance = map[time.Time]map[string]time.Time{}
+	// MapAttendance is a map of dateTimes to a map of user IDs to attendance records
+	MapAttendance = map[time.Time]map[string]Attendance{}
+
+	MapSchedulesMutex sync.Mutex
+	// MapSchedules is a map of schedule IDs to scheduled class sessions
+	MapSchedules = map[string]Schedule{}
+
+	MapLocationsMutex sync.Mutex
+	// MapLocations is a map of location IDs to locations
+	MapLocations = map[string]Location{}
+
+	MapCoursesMutex sync.Mutex
+	// MapCourses is a map of course IDs to courses
+	MapCourses = map[string]Course{}
+
+	MapEnrollmentsMutex sync.Mutex
+	// MapEnrollments is a map of course IDs to a map of user IDs to enrollments
+	MapEnrollments = map[string]map[string]Enrollment{}
+
+	AuditLogMutex sync.Mutex
+	// AuditLog is the list of audit entries, oldest first
+	AuditLog = []AuditEntry{}
 )
 
 func init() {
@@ -41,25 +90,78 @@ func init() {
 	}()
 
 	logger.Println("Initializing envs...")
+	// A missing .env file leaves the envs to the environment, as when running tests
 	err := godotenv.Load("../.env")
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Println("No .env file, using the environment")
+	} else if err != nil {
 		log.Fatalln("Error loading .env file")
+	} else {
+		logger.Println("Success!")
+	}
+
+	logger.Println("Initializing store...")
+	store, err = db.Open(os.Getenv("APP_DB_DRIVER"), os.Getenv("APP_DB_DSN"))
+	if err != nil {
+		log.Fatalln("error opening store::" + err.Error())
 	}
 	logger.Println("Success!")
 
-	// init users from users.json
-	logger.Println("Initializing users")
-	// Can potentially panic if unable to read from file
-	if err := db.Read("users.json", &MapUsers); err != nil {
-		logger.Println(err)
+	// Recover writes that were journaled but did not reach the store before the last shutdown
+	logger.Println("Replaying journal...")
+	if err := store.Replay(); err != nil {
+		log.Fatalln("error replaying journal::" + err.Error())
 	}
 	logger.Println("Success!")
 
-	// init attendance from attendance.json
 	logger.Println("Initializing users")
-	// Can potentially panic if unable to read from file
-	if err := db.Read("attendance.json", &MapAttendance); err != nil {
-		logger.Println(err)
+	if MapUsers, err = store.LoadUsers(); err != nil {
+		log.Fatalln("error loading users::" + err.Error())
+	}
+	for id, user := range MapUsers {
+		if user.Role == "" {
+			user.Role = legacyRole(id)
+			MapUsers[id] = user
+		}
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing sessions")
+	if MapSessions, err = store.LoadSessions(); err != nil {
+		log.Fatalln("error loading sessions::" + err.Error())
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing attendance")
+	if MapAttendance, err = store.LoadAttendance(); err != nil {
+		log.Fatalln("error loading attendance::" + err.Error())
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing schedules")
+	if MapSchedules, err = store.LoadSchedules(); err != nil {
+		log.Fatalln("error loading schedules::" + err.Error())
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing locations")
+	if MapLocations, err = store.LoadLocations(); err != nil {
+		log.Fatalln("error loading locations::" + err.Error())
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing courses")
+	if MapCourses, err = store.LoadCourses(); err != nil {
+		log.Fatalln("error loading courses::" + err.Error())
+	}
+	if MapEnrollments, err = store.LoadEnrollments(); err != nil {
+		log.Fatalln("error loading enrollments::" + err.Error())
+	}
+	logger.Println("Success!")
+
+	logger.Println("Initializing audit log")
+	if AuditLog, err = store.LoadAuditEntries(); err != nil {
+		log.Fatalln("error loading audit log::" + err.Error())
 	}
 	logger.Println("Success!")
 }
@@ -73,43 +175,90 @@ func GetMapUser(userID string) (User, bool) {
 }
 
 // GetAllMapUsers is the thread-safe getter for MapUsers map
+// A copy is returned so that callers can iterate without holding the lock.
 func GetAllMapUsers() map[string]User {
 	MapUsersMutex.Lock()
 	defer MapUsersMutex.Unlock()
-	return MapUsers
+
+	result := make(map[string]User, len(MapUsers))
+	for k, v := range MapUsers {
+		result[k] = v
+	}
+	return result
 }
 
 // SetMapUser is the thread-safe setter for MapUsers
-func SetMapUser(userID string, user User) {
+// The user is persisted to the store before MapUsers is updated.
+func SetMapUser(userID string, user User) error {
+	user.ID = userID
+	return SetMapUsers(user)
+}
+
+// SetMapUsers is the thread-safe setter for multiple values within MapUsers
+// All users are persisted to the store in a single write before MapUsers is updated.
+func SetMapUsers(users ...User) error {
 	MapUsersMutex.Lock()
 	defer MapUsersMutex.Unlock()
-	MapUsers[userID] = user
+
+	if err := store.PutUsers(users...); err != nil {
+		return err
+	}
+	for _, user := range users {
+		MapUsers[user.ID] = user
+	}
+	return nil
 }
 
 // GetMapSession is the thread-safe getter for values within MapSessions
-func GetMapSession(sessionID string) (string, bool) {
+func GetMapSession(sessionID string) (Session, bool) {
 	MapSessionsMutex.Lock()
 	defer MapSessionsMutex.Unlock()
-	userID, ok := MapSessions[sessionID]
-	return userID, ok
+	session, ok := MapSessions[sessionID]
+	return session, ok
 }
 
-// GetAllMapSessions is the thread-safe getter for MapUsers map
-func GetAllMapSessions() map[string]string {
+// GetAllMapSessions is the thread-safe getter for MapSessions map
+// A copy is returned so that callers can iterate without holding the lock.
+func GetAllMapSessions() map[string]Session {
 	MapSessionsMutex.Lock()
 	defer MapSessionsMutex.Unlock()
-	return MapSessions
+
+	result := make(map[string]Session, len(MapSessions))
+	for k, v := range MapSessions {
+		result[k] = v
+	}
+	return result
 }
 
 // SetMapSession is the thread-safe setter for MapSessions
-func SetMapSession(sessionID, userID string) {
+// The session is persisted to the store before MapSessions is updated.
+func SetMapSession(sessionID string, session Session) error {
 	MapSessionsMutex.Lock()
 	defer MapSessionsMutex.Unlock()
-	MapSessions[sessionID] = userID
+
+	if err := store.PutSession(sessionID, session); err != nil {
+		return err
+	}
+	MapSessions[sessionID] = session
+	return nil
+}
+
+// DeleteMapSessions is the thread-safe deleter for MapSessions
+func DeleteMapSessions(sessionIDs ...string) error {
+	MapSessionsMutex.Lock()
+	defer MapSessionsMutex.Unlock()
+
+	if err := store.DeleteSessions(sessionIDs...); err != nil {
+		return err
+	}
+	for _, sessionID := range sessionIDs {
+		delete(MapSessions, sessionID)
+	}
+	return nil
 }
 
 // GetMapAttendanceOuter is the thread-safe getter for values within the outer MapAttendance map
-func GetMapAttendanceOuter(dateTime time.Time) (map[string]time.Time, bool) {
+func GetMapAttendanceOuter(dateTime time.Time) (map[string]Attendance, bool) {
 	MapAttendanceMutex.Lock()
 	defer MapAttendanceMutex.Unlock()
 
@@ -119,7 +268,7 @@ func GetMapAttendanceOuter(dateTime time.Time) (map[string]time.Time, bool) {
 	}
 
 	// Creating a copy to avoid concurrent map read and map write
-	result := make(map[string]time.Time, len(innerMap))
+	result := make(map[string]Attendance, len(innerMap))
 	for k, v := range innerMap {
 		result[k] = v
 	}
@@ -128,14 +277,21 @@ func GetMapAttendanceOuter(dateTime time.Time) (map[string]time.Time, bool) {
 }
 
 // GetAllMapAttendanceOuter is the thread-safe getter for the outer MapAttendance map
-func GetAllMapAttendanceOuter() map[time.Time]map[string]time.Time {
+func GetAllMapAttendanceOuter() map[time.Time]map[string]Attendance {
 	MapAttendanceMutex.Lock()
 	defer MapAttendanceMutex.Unlock()
 	return MapAttendance
 }
 
+// AttendanceDate returns the MapAttendance key of the day t falls on.
+// The calendar date is taken in the time zone of t, so that check-ins are filed under the day of the location they were made at,
+// while keys are always midnight in the server's time zone so that they remain comparable.
+func AttendanceDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
 // GetMapAttendanceInner is the thread-safe getter for values within the inner MapAttendance map
-func GetMapAttendanceInner(dateTime time.Time, userID string) (time.Time, bool) {
+func GetMapAttendanceInner(dateTime time.Time, userID string) (Attendance, bool) {
 	MapAttendanceMutex.Lock()
 	defer MapAttendanceMutex.Unlock()
 
@@ -144,25 +300,257 @@ func GetMapAttendanceInner(dateTime time.Time, userID string) (time.Time, bool)
 		return value, userExists
 	}
 
-	return time.Time{}, false
+	return Attendance{}, false
 }
 
 // SetMapAttendanceInner is the thread-safe setter for the inner MapAttendance map
-func SetMapAttendanceInner(dateTime time.Time, userID string, value time.Time) {
+// The record is persisted to the store before MapAttendance is updated.
+func SetMapAttendanceInner(dateTime time.Time, userID string, value Attendance) error {
 	MapAttendanceMutex.Lock()
 	defer MapAttendanceMutex.Unlock()
 
+	if err := store.PutAttendance(dateTime, userID, value); err != nil {
+		return err
+	}
+
 	if _, ok := MapAttendance[dateTime]; !ok {
-		MapAttendance[dateTime] = make(map[string]time.Time)
+		MapAttendance[dateTime] = make(map[string]Attendance)
 	}
 
 	MapAttendance[dateTime][userID] = value
+	return nil
 }
 
-// SetMapAttendanceOuter is the thread-safe setter for the outer MapAttendance map
-func SetMapAttendanceOuter(dateTime time.Time, values map[string]time.Time) {
-	MapAttendanceMutex.Lock()
-	defer MapAttendanceMutex.Unlock()
+// GetMapSchedule is the thread-safe getter for values within MapSchedules
+func GetMapSchedule(scheduleID string) (Schedule, bool) {
+	MapSchedulesMutex.Lock()
+	defer MapSchedulesMutex.Unlock()
+	schedule, ok := MapSchedules[scheduleID]
+	return schedule, ok
+}
 
-	MapAttendance[dateTime] = values
+// GetAllMapSchedules is the thread-safe getter for MapSchedules map
+// A copy is returned so that callers can iterate without holding the lock.
+func GetAllMapSchedules() map[string]Schedule {
+	MapSchedulesMutex.Lock()
+	defer MapSchedulesMutex.Unlock()
+
+	result := make(map[string]Schedule, len(MapSchedules))
+	for k, v := range MapSchedules {
+		result[k] = v
+	}
+	return result
+}
+
+// SetMapSchedule is the thread-safe setter for MapSchedules
+// The schedule is persisted to the store before MapSchedules is updated.
+func SetMapSchedule(schedule Schedule) error {
+	MapSchedulesMutex.Lock()
+	defer MapSchedulesMutex.Unlock()
+
+	if err := store.PutSchedule(schedule); err != nil {
+		return err
+	}
+	MapSchedules[schedule.ID] = schedule
+	return nil
+}
+
+// DeleteMapSchedule is the thread-safe deleter for MapSchedules
+func DeleteMapSchedule(scheduleID string) error {
+	MapSchedulesMutex.Lock()
+	defer MapSchedulesMutex.Unlock()
+
+	if err := store.DeleteSchedule(scheduleID); err != nil {
+		return err
+	}
+	delete(MapSchedules, scheduleID)
+	return nil
+}
+
+// GetMapLocation is the thread-safe getter for values within MapLocations
+func GetMapLocation(locationID string) (Location, bool) {
+	MapLocationsMutex.Lock()
+	defer MapLocationsMutex.Unlock()
+	location, ok := MapLocations[locationID]
+	return location, ok
+}
+
+// GetAllMapLocations is the thread-safe getter for MapLocations map
+// A copy is returned so that callers can iterate without holding the lock.
+func GetAllMapLocations() map[string]Location {
+	MapLocationsMutex.Lock()
+	defer MapLocationsMutex.Unlock()
+
+	result := make(map[string]Location, len(MapLocations))
+	for k, v := range MapLocations {
+		result[k] = v
+	}
+	return result
+}
+
+// SetMapLocation is the thread-safe setter for MapLocations
+// The location is persisted to the store before MapLocations is updated.
+func SetMapLocation(location Location) error {
+	MapLocationsMutex.Lock()
+	defer MapLocationsMutex.Unlock()
+
+	if err := store.PutLocation(location); err != nil {
+		return err
+	}
+	MapLocations[location.ID] = location
+	return nil
+}
+
+// DeleteMapLocation is the thread-safe deleter for MapLocations
+func DeleteMapLocation(locationID string) error {
+	MapLocationsMutex.Lock()
+	defer MapLocationsMutex.Unlock()
+
+	if err := store.DeleteLocation(locationID); err != nil {
+		return err
+	}
+	delete(MapLocations, locationID)
+	return nil
+}
+
+// GetMapCourse is the thread-safe getter for values within MapCourses
+func GetMapCourse(courseID string) (Course, bool) {
+	MapCoursesMutex.Lock()
+	defer MapCoursesMutex.Unlock()
+	course, ok := MapCourses[courseID]
+	return course, ok
+}
+
+// GetAllMapCourses is the thread-safe getter for MapCourses map
+// A copy is returned so that callers can iterate without holding the lock.
+func GetAllMapCourses() map[string]Course {
+	MapCoursesMutex.Lock()
+	defer MapCoursesMutex.Unlock()
+
+	result := make(map[string]Course, len(MapCourses))
+	for k, v := range MapCourses {
+		result[k] = v
+	}
+	return result
+}
+
+// SetMapCourse is the thread-safe setter for MapCourses
+// The course is persisted to the store before MapCourses is updated.
+func SetMapCourse(course Course) error {
+	MapCoursesMutex.Lock()
+	defer MapCoursesMutex.Unlock()
+
+	if err := store.PutCourse(course); err != nil {
+		return err
+	}
+	MapCourses[course.ID] = course
+	return nil
+}
+
+// DeleteMapCourse is the thread-safe deleter for MapCourses, which also removes the enrollments of the course
+func DeleteMapCourse(courseID string) error {
+	MapCoursesMutex.Lock()
+	defer MapCoursesMutex.Unlock()
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+
+	if err := store.DeleteCourse(courseID); err != nil {
+		return err
+	}
+	delete(MapCourses, courseID)
+	delete(MapEnrollments, courseID)
+	return nil
+}
+
+// GetMapCourseEnrollments is the thread-safe getter for the enrollments of a course within MapEnrollments
+// A copy is returned so that callers can iterate without holding the lock.
+func GetMapCourseEnrollments(courseID string) map[string]Enrollment {
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+
+	result := make(map[string]Enrollment, len(MapEnrollments[courseID]))
+	for k, v := range MapEnrollments[courseID] {
+		result[k] = v
+	}
+	return result
+}
+
+// GetMapUserCourseIDs returns the IDs of the courses a user is enrolled in
+func GetMapUserCourseIDs(userID string) []string {
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+
+	courseIDs := []string{}
+	for courseID, users := range MapEnrollments {
+		if _, ok := users[userID]; ok {
+			courseIDs = append(courseIDs, courseID)
+		}
+	}
+	return courseIDs
+}
+
+// IsMapEnrolled reports whether a user is enrolled in a course
+func IsMapEnrolled(courseID string, userID string) bool {
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+	_, ok := MapEnrollments[courseID][userID]
+	return ok
+}
+
+// SetMapEnrollments is the thread-safe setter for MapEnrollments
+// The enrollments are persisted to the store in a single write before MapEnrollments is updated.
+func SetMapEnrollments(enrollments ...Enrollment) error {
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+
+	if err := store.PutEnrollments(enrollments...); err != nil {
+		return err
+	}
+	for _, enrollment := range enrollments {
+		if _, ok := MapEnrollments[enrollment.CourseID]; !ok {
+			MapEnrollments[enrollment.CourseID] = map[string]Enrollment{}
+		}
+		MapEnrollments[enrollment.CourseID][enrollment.UserID] = enrollment
+	}
+	return nil
+}
+
+// DeleteMapEnrollments is the thread-safe deleter for the enrollments of users in a course within MapEnrollments
+func DeleteMapEnrollments(courseID string, userIDs ...string) error {
+	MapEnrollmentsMutex.Lock()
+	defer MapEnrollmentsMutex.Unlock()
+
+	if err := store.DeleteEnrollments(courseID, userIDs...); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		delete(MapEnrollments[courseID], userID)
+	}
+	return nil
+}
+
+// GetAuditLog is the thread-safe getter for AuditLog
+// It returns a copy of the entries, newest first.
+func GetAuditLog() []AuditEntry {
+	AuditLogMutex.Lock()
+	defer AuditLogMutex.Unlock()
+
+	result := make([]AuditEntry, 0, len(AuditLog))
+	for i := len(AuditLog) - 1; i >= 0; i-- {
+		result = append(result, AuditLog[i])
+	}
+	return result
+}
+
+// AppendAuditLog is the thread-safe appender for AuditLog
+// The entry is persisted to the store before AuditLog is updated.
+func AppendAuditLog(entry AuditEntry) error {
+	AuditLogMutex.Lock()
+	defer AuditLogMutex.Unlock()
+
+	if err := store.AppendAuditEntry(entry); err != nil {
+		return err
+	}
+	AuditLog = append(AuditLog, entry)
+	return nil
 }
@@ -7,94 +7,340 @@ Initialization:
 
 During package initialization, the Tpl variable is initialized with HTML templates and associated functions.
 
-Note: The templates are assumed to be located in the "./templates/" directory and have a ".gohtml" extension.
+Note: The templates are the ".gohtml" files of the templates directory, embedded in the binary so that they load regardless of the working directory.
 */
 package templates
 
 import (
+	"embed"
+	"fmt"
 	"html/template"
+	"io"
+	"sort"
 	"time"
 
 	"attendance.com/src/logger"
 	"attendance.com/src/states"
 )
 
-// AttendanceDetails struct represents details about a user's attendance, including check-in time and name
+// TimeFormat is the layout used to display check-in and check-out times
+const TimeFormat = "Monday, 2 Jan 2006, 3:04:05 PM"
+
+// AttendanceDetails struct represents details about a user's attendance, including check-in and check-out times, time on site and name
+// CheckOutTime and Duration are empty if the user has not checked out, and all times are empty if the user is absent.
+// Status is the readable Present, Late or Absent classification of the user for the day,
+// Location the name of the location checked in at, and Course the code of the course checked in for.
+// Record is the underlying attendance record, zero if the user is absent.
 type AttendanceDetails struct {
-	CheckInTime string
-	Name        string
+	CheckInTime  string
+	CheckOutTime string
+	Duration     string
+	Status       string
+	Absent       bool
+	Name         string
+	Location     string
+	Course       string
+	Record       states.Attendance
+}
+
+// AttendanceFilters struct represents the filters of an attendance report
+// DateFrom and DateTo are "YYYY-MM-DD" dates, and Location and Course are IDs, left empty to not filter on them.
+// Courses restricts the report to the given course IDs on top of the other filters, nil to not restrict it.
+type AttendanceFilters struct {
+	DateFrom string
+	DateTo   string
+	Location string
+	Course   string
+	Courses  []string
 }
 
-// CheckedInUsers is a map of date to map of user id to check in time
+// CheckedInUsers is a map of date to map of user id to attendance details, listing every enrolled user including absentees
 type CheckedInUsers map[string]map[string]AttendanceDetails
 
+// AbsentLabel is the status of enrolled users who did not check in
+const AbsentLabel = "Absent"
+
+// SingleSignOn is the name of the OIDC provider users can sign in through, shown on the login form.
+// It is set by the services when a provider is configured, and left empty otherwise.
+var SingleSignOn string
+
+// files holds the HTML templates
+//
+//go:embed *.gohtml
+var files embed.FS
+
 // Tpl is a pointer to a template.Template object that holds all initialized HTML templates
 var Tpl *template.Template
 
 func init() {
 	logger.Println("Initializing templates...")
 	Tpl = template.Must(template.New("").Funcs(template.FuncMap{
-		"isCheckedIn": IsCheckedIn,
-		"getCheckIns": GetCheckedInUsers,
-	}).ParseGlob("./templates/*.gohtml"))
+		"isCheckedIn":    IsCheckedIn,
+		"isCheckedOut":   IsCheckedOut,
+		"timeOnSite":     TimeOnSite,
+		"getCheckIns":    GetCheckedInUsers,
+		"getLocations":   GetLocations,
+		"can":            Can,
+		"getRoles":       GetRoles,
+		"getCourses":     GetCourses,
+		"userCourses":    GetUserCourses,
+		"getInstructors": GetInstructors,
+		"singleSignOn":   func() string { return SingleSignOn },
+		// csrfField is replaced by Render with the CSRF token of the request
+		"csrfField": csrfField(""),
+	}).ParseFS(files, "*.gohtml"))
 	logger.Println("Templates ready!")
 
 }
 
+// Render executes the named template, embedding the CSRF token in the forms that call csrfField.
+// Templates must be executed through Render rather than Tpl, so that every request gets its own token.
+func Render(w io.Writer, name string, data interface{}, csrfToken string) error {
+	tpl, err := Tpl.Clone()
+	if err != nil {
+		return err
+	}
+	return tpl.Funcs(template.FuncMap{"csrfField": csrfField(csrfToken)}).ExecuteTemplate(w, name, data)
+}
+
+// csrfField returns a template function rendering the hidden form input that holds the CSRF token.
+func csrfField(token string) func() template.HTML {
+	return func() template.HTML {
+		return template.HTML(`<input type="hidden" name="csrfToken" value="` + template.HTMLEscapeString(token) + `">`)
+	}
+}
+
 // IsCheckedIn checks if a user is already checked in and returns the check-in time in a formatted string.
 // If the user is not checked in, it returns an empty string.
 func IsCheckedIn(id string) string {
+	if record, ok := todaysAttendance(id); ok {
+		return record.CheckIn.Format(TimeFormat)
+	}
+	return ""
+}
+
+// IsCheckedOut checks if a user has checked out for the day and returns the check-out time in a formatted string.
+// If the user is not checked out, it returns an empty string.
+func IsCheckedOut(id string) string {
+	if record, ok := todaysAttendance(id); ok && record.IsCheckedOut() {
+		return record.CheckOut.Format(TimeFormat)
+	}
+	return ""
+}
+
+// TimeOnSite returns the formatted time spent on site today by a user who has checked out.
+// If the user is not checked out, it returns an empty string.
+func TimeOnSite(id string) string {
+	if record, ok := todaysAttendance(id); ok && record.IsCheckedOut() {
+		return FormatDuration(record.Duration())
+	}
+	return ""
+}
+
+// StatusLabel returns the readable label of the status of a check-in.
+// Records created before statuses were tracked are labelled as present.
+func StatusLabel(status string) string {
+	switch status {
+	case states.StatusLate:
+		return "Late"
+	case states.StatusOutsideSession:
+		return "Present (outside session)"
+	default:
+		return "Present"
+	}
+}
+
+// FormatDuration formats a time on site as hours and minutes, e.g. "7h 05m".
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// todaysAttendance returns the attendance record of a user for the current day.
+// Check-ins are filed under the day of the location they were made at, which may be a day apart from the server's,
+// so the neighbouring days are looked up as well and matched against the current day in the time zone of the check-in.
+func todaysAttendance(id string) (states.Attendance, bool) {
 	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, offset := range []int{0, 1, -1} {
+		date := states.AttendanceDate(now).AddDate(0, 0, offset)
+		record, ok := states.GetMapAttendanceInner(date, id)
+		if ok && states.AttendanceDate(now.In(record.CheckIn.Location())).Equal(date) {
+			return record, true
+		}
+	}
+	return states.Attendance{}, false
+}
+
+// Can reports whether the role of the user grants the named permission, for use in templates.
+func Can(user states.User, permission string) bool {
+	return states.Can(user, states.Permission(permission))
+}
+
+// GetRoles returns every role a user can be assigned.
+func GetRoles() []string {
+	return states.Roles
+}
 
-	// Check if user is already checked in
-	if loggedInUsers, ok := states.GetMapAttendanceOuter(today); ok {
-		if checkedInTime, ok := loggedInUsers[id]; ok {
-			return checkedInTime.Format("Monday, 2 Jan 2006, 3:04:05 PM")
+// GetInstructors returns every user with the instructor role, sorted by ID.
+func GetInstructors() []states.User {
+	instructors := []states.User{}
+	for _, user := range states.GetAllMapUsers() {
+		if user.Role == states.RoleInstructor {
+			instructors = append(instructors, user)
 		}
-		return ""
 	}
-	return ""
+	sort.Slice(instructors, func(i, j int) bool {
+		return instructors[i].ID < instructors[j].ID
+	})
+	return instructors
+}
+
+// GetCourses returns all courses sorted by code.
+func GetCourses() []states.Course {
+	return sortCourses(states.GetAllMapCourses())
+}
+
+// GetUserCourses returns the courses a user is enrolled in, sorted by code.
+func GetUserCourses(userID string) []states.Course {
+	courses := map[string]states.Course{}
+	for _, courseID := range states.GetMapUserCourseIDs(userID) {
+		if course, ok := states.GetMapCourse(courseID); ok {
+			courses[courseID] = course
+		}
+	}
+	return sortCourses(courses)
+}
+
+// sortCourses returns the courses of a map sorted by code.
+func sortCourses(byID map[string]states.Course) []states.Course {
+	courses := make([]states.Course, 0, len(byID))
+	for _, course := range byID {
+		courses = append(courses, course)
+	}
+	sort.Slice(courses, func(i, j int) bool {
+		if courses[i].Code != courses[j].Code {
+			return courses[i].Code < courses[j].Code
+		}
+		return courses[i].ID < courses[j].ID
+	})
+	return courses
 }
 
-// GetCheckedInUsers retrieves a map of checked-in users within a specified date range.
-// The date range is specified by the dateFrom and dateTo parameters, which are expected to be in the format "YYYY-MM-DD".
-func GetCheckedInUsers(dateFrom string, dateTo string) CheckedInUsers {
+// GetLocations returns all locations sorted by name.
+func GetLocations() []states.Location {
+	locations := []states.Location{}
+	for _, location := range states.GetAllMapLocations() {
+		locations = append(locations, location)
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].Name != locations[j].Name {
+			return locations[i].Name < locations[j].Name
+		}
+		return locations[i].ID < locations[j].ID
+	})
+	return locations
+}
+
+// GetCheckedInUsers retrieves the attendance of every enrolled user within the date range of the filters.
+// Users who did not check in on a date are listed as absent.
+// If a course is given, only the students enrolled in the course are listed, and check-ins made for other courses count as absences.
+// The same applies to the set of courses the report is restricted to, if any.
+// If a location is given, only check-ins made at that location are listed, since absentees cannot be attributed to a location.
+func GetCheckedInUsers(filters AttendanceFilters) CheckedInUsers {
 	checkedInUsers := make(CheckedInUsers)
-	if dateFrom == "" || dateTo == "" {
+	if filters.DateFrom == "" || filters.DateTo == "" {
 		return checkedInUsers
 	}
-	dateFromTime, err := time.ParseInLocation("2006-01-02", dateFrom, time.Now().Location())
+	dateFromTime, err := time.ParseInLocation("2006-01-02", filters.DateFrom, time.Now().Location())
 	if err != nil {
 		return checkedInUsers
 	}
-	dateToTime, err := time.ParseInLocation("2006-01-02", dateTo, time.Now().Location())
+	dateToTime, err := time.ParseInLocation("2006-01-02", filters.DateTo, time.Now().Location())
 	if err != nil {
 		return checkedInUsers
 	}
 
+	users := states.GetAllMapUsers()
+	scope := courseScope(filters)
+	if scope != nil {
+		enrolled := map[string]bool{}
+		for courseID := range scope {
+			for id := range states.GetMapCourseEnrollments(courseID) {
+				enrolled[id] = true
+			}
+		}
+		for id := range users {
+			if !enrolled[id] {
+				delete(users, id)
+			}
+		}
+	}
+	locations := states.GetAllMapLocations()
+	courses := states.GetAllMapCourses()
 	for dateFromTime.Before(dateToTime) || dateFromTime.Equal(dateToTime) {
 		k := dateFromTime.Format("2006-01-02")
-		if loggedInUsers, ok := states.GetMapAttendanceOuter(dateFromTime); ok {
-			checkedInUsers[k] = make(map[string]AttendanceDetails)
-			for id := range states.GetAllMapUsers() {
-				if id == "admin" {
-					continue
-				}
-				if checkedInTime, ok := loggedInUsers[id]; ok {
-					if usr, ok := states.GetMapUser(id); ok {
-						checkedInUsers[k][id] = AttendanceDetails{
-							CheckInTime: checkedInTime.Format("Monday, 2 Jan 2006, 3:04:05 PM"),
-							Name:        usr.First + " " + usr.Last,
-						}
-					}
-				}
+		// loggedInUsers is nil if nobody checked in on this date
+		loggedInUsers, _ := states.GetMapAttendanceOuter(dateFromTime)
+		checkedInUsers[k] = make(map[string]AttendanceDetails)
+		for id, usr := range users {
+			// only students are expected to attend
+			if usr.Role != states.RoleStudent {
+				continue
+			}
+
+			details := AttendanceDetails{
+				Name: usr.First + " " + usr.Last,
+			}
+			record, ok := loggedInUsers[id]
+			if ok && scope != nil && !scope[record.CourseID] {
+				ok = false
+			}
+			if filters.Location != "" && (!ok || record.LocationID != filters.Location) {
+				continue
+			}
+			// deactivated students are no longer expected to attend, but their check-ins are kept
+			if !ok && usr.Deactivated {
+				continue
+			}
+			if !ok {
+				details.Status = AbsentLabel
+				details.Absent = true
+				checkedInUsers[k][id] = details
+				continue
 			}
-		} else {
-			checkedInUsers[k] = nil
+
+			details.Record = record
+			details.CheckInTime = record.CheckIn.Format(TimeFormat)
+			details.Status = StatusLabel(record.Status)
+			details.Location = locations[record.LocationID].Name
+			details.Course = courses[record.CourseID].Code
+			if record.IsCheckedOut() {
+				details.CheckOutTime = record.CheckOut.Format(TimeFormat)
+				details.Duration = FormatDuration(record.Duration())
+			}
+			checkedInUsers[k][id] = details
 		}
 		dateFromTime = dateFromTime.AddDate(0, 0, 1)
 	}
 
 	return checkedInUsers
 }
+
+// courseScope returns the set of course IDs an attendance report is restricted to, or nil if it is not restricted.
+func courseScope(filters AttendanceFilters) map[string]bool {
+	if filters.Course == "" && filters.Courses == nil {
+		return nil
+	}
+
+	scope := map[string]bool{}
+	if filters.Courses == nil {
+		scope[filters.Course] = true
+		return scope
+	}
+	for _, courseID := range filters.Courses {
+		if filters.Course == "" || courseID == filters.Course {
+			scope[courseID] = true
+		}
+	}
+	return scope
+}
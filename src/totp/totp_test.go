@@ -0,0 +1,84 @@
+package totp_test
+
+import (
+	"testing"
+	"time"
+
+	"attendance.com/src/totp"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890" base32-encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last 6 digits of the 8-digit SHA-1 codes of RFC 6238 appendix B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			got, err := totp.Code(rfcSecret, totp.Step(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatalf("Code() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Code() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	if code, err := totp.Code("not base32!", 1); err == nil {
+		t.Errorf("Code() = %q, want an error", code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totp.Step(now)
+	codeAt := func(step int64) string {
+		code, err := totp.Code(rfcSecret, step)
+		if err != nil {
+			t.Fatalf("Code() error = %v", err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", codeAt(current), 0, current, true},
+		{"one step early", codeAt(current - totp.Skew), 0, current - totp.Skew, true},
+		{"one step late", codeAt(current + totp.Skew), 0, current + totp.Skew, true},
+		{"spaces around digits", " 050 471 ", 0, current, true},
+		{"beyond skew before", codeAt(current - totp.Skew - 1), 0, 0, false},
+		{"beyond skew after", codeAt(current + totp.Skew + 1), 0, 0, false},
+		{"step already used", codeAt(current), current, 0, false},
+		{"step before last used", codeAt(current - totp.Skew), current - totp.Skew + 1, 0, false},
+		{"later step than last used", codeAt(current + totp.Skew), current, current + totp.Skew, true},
+		{"wrong code", "000000", 0, 0, false},
+		{"too short", "05047", 0, 0, false},
+		{"empty", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := totp.Validate(rfcSecret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate() = %d, %v, want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
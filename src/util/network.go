@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"attendance.com/src/logger"
+)
+
+// Network configuration, parsed from envs on first use since envs are loaded after package initialization
+var (
+	networksOnce sync.Once
+	// validNetworks are the networks check-ins are accepted from (VALID_IP_CIDRS)
+	validNetworks []netip.Prefix
+	// trustedProxies are the proxies whose forwarding header is honored (TRUSTED_PROXIES)
+	trustedProxies []netip.Prefix
+	// trustedProxyHeader is the forwarding header the trusted proxies set (TRUSTED_PROXY_HEADER)
+	trustedProxyHeader string
+)
+
+// headerForwardedFor is the forwarding header that proxies append the address they received the request from to
+const headerForwardedFor = "X-Forwarded-For"
+
+func loadNetworks() {
+	var err error
+	validNetworks, err = ParseNetworks(os.Getenv("VALID_IP_CIDRS"))
+	if err != nil {
+		logger.Println(err)
+	}
+
+	// Fall back to the legacy VALID_IP_ADDR, which only matched the first two octets
+	if len(validNetworks) == 0 && os.Getenv("VALID_IP_ADDR") != "" {
+		if addr, err := netip.ParseAddr(os.Getenv("VALID_IP_ADDR")); err == nil && addr.Is4() {
+			prefix, _ := addr.Prefix(16)
+			validNetworks = []netip.Prefix{prefix}
+		} else {
+			logger.Println("Invalid VALID_IP_ADDR: " + os.Getenv("VALID_IP_ADDR"))
+		}
+	}
+
+	trustedProxies, err = ParseNetworks(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Println(err)
+	}
+
+	trustedProxyHeader = http.CanonicalHeaderKey(os.Getenv("TRUSTED_PROXY_HEADER"))
+	if trustedProxyHeader == "" {
+		trustedProxyHeader = headerForwardedFor
+	}
+}
+
+// ValidateClientIPHandler validates the IP address of the user to ensure it is within the configured networks and returns a boolean indication and error.
+// It returns true if the IP address is valid, false if it is not, and an error if the address cannot be determined.
+// It is used to ensure that users are on the appropriate WIFI before checking in.
+func ValidateClientIPHandler(r *http.Request) (bool, error) {
+	addr, err := ClientAddr(r)
+	if err != nil {
+		return false, err
+	}
+
+	return InNetworks(addr, validNetworks), nil
+}
+
+// ClientAddr returns the IP address of the client that sent the request, honoring the forwarding header of the configured trusted proxies.
+func ClientAddr(r *http.Request) (netip.Addr, error) {
+	networksOnce.Do(loadNetworks)
+	return ClientIP(r, trustedProxies, trustedProxyHeader)
+}
+
+// ClientIP returns the IP address of the client that sent the request.
+// The forwarding header is only honored when the request comes from one of the trusted proxies,
+// otherwise the address of the connection is used so that clients cannot spoof their address.
+// Other forwarding headers are ignored, since proxies that do not set them pass through the values the client sent.
+// X-Forwarded-For is walked from the right, while any other header, such as X-Real-Ip or CF-Connecting-IP,
+// must hold the single address the proxy overwrites it with.
+func ClientIP(r *http.Request, trusted []netip.Prefix, header string) (netip.Addr, error) {
+	remote, err := ParseAddr(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %q: %w", r.RemoteAddr, err)
+	}
+	if !InNetworks(remote, trusted) {
+		return remote, nil
+	}
+
+	if header != headerForwardedFor {
+		if value := r.Header.Get(header); value != "" {
+			return ParseAddr(value)
+		}
+		return remote, nil
+	}
+
+	// Each proxy appends the address it received the request from, so the client is
+	// the right-most address that is not one of our trusted proxies
+	if forwarded := r.Header.Values(headerForwardedFor); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := ParseAddr(hops[i])
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("invalid X-Forwarded-For address %q: %w", hops[i], err)
+			}
+			if i == 0 || !InNetworks(addr, trusted) {
+				return addr, nil
+			}
+		}
+	}
+
+	return remote, nil
+}
+
+// ParseAddr parses an IPv4 or IPv6 address, with or without a port, such as "10.0.0.1", "10.0.0.1:5332" or "[::1]:5332".
+// IPv4-mapped IPv6 addresses are unmapped so that they match IPv4 networks.
+func ParseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// ParseNetworks parses a comma-separated list of CIDR ranges such as "10.1.0.0/16, 2001:db8::/32".
+// Bare addresses are accepted as single-host ranges.
+// Invalid entries are skipped and reported in the returned error, along with the valid ranges.
+func ParseNetworks(list string) ([]netip.Prefix, error) {
+	networks := []netip.Prefix{}
+	errs := []error{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := ParseAddr(entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid network %q: %w", entry, err))
+				continue
+			}
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid network %q: %w", entry, err))
+			continue
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		networks = append(networks, prefix.Masked())
+	}
+
+	return networks, errors.Join(errs...)
+}
+
+// InNetworks reports whether the address is within any of the networks.
+func InNetworks(addr netip.Addr, networks []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
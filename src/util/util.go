@@ -1,26 +1,42 @@
 /*
 Package utils provides various utility functions that can be used throughout the application.
 
-The utils package includes functions for validating IP addresses, reading and writing CSV files, and other general-purpose utilities.
+The utils package includes functions for validating IP addresses, reading and writing CSV files, reading Excel workbooks, and other general-purpose utilities.
 */
 package utils
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"attendance.com/src/logger"
+	"github.com/xuri/excelize/v2"
 )
 
 // ReadCSV reads CSV data from the given io.Reader.
 // It returns a 2D slice of strings representing the CSV data and an error.
+// A leading UTF-8 byte order mark is skipped, and files whose first line has more semicolons than commas are read as
+// semicolon-delimited, as exported by spreadsheets in locales using the comma as decimal separator.
 func ReadCSV(file io.Reader) ([][]string, error) {
-	reader := csv.NewReader(file)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+	// rows with a wrong number of fields are reported by the callers validating them, rather than failing the whole file
+	reader.FieldsPerRecord = -1
 	records, err := reader.ReadAll()
 	if err != nil {
 		return nil, err
@@ -28,6 +44,34 @@ func ReadCSV(file io.Reader) ([][]string, error) {
 	return records, nil
 }
 
+// ReadXLSX reads the rows of the first sheet of an Excel workbook from the given io.Reader, in the same form as ReadCSV.
+// Blank rows are kept so that rows keep their number in the sheet, only trailing blank rows being dropped,
+// and rows whose trailing cells are empty are padded to the width of the first row, since the workbook does not record the empty cells.
+// The workbook may unzip to at most unzipLimit bytes, so that a small upload cannot expand without bound.
+func ReadXLSX(file io.Reader, unzipLimit int64) ([][]string, error) {
+	workbook, err := excelize.OpenReader(file, excelize.Options{UnzipSizeLimit: unzipLimit, UnzipXMLSizeLimit: unzipLimit})
+	if err != nil {
+		return nil, err
+	}
+	defer workbook.Close()
+
+	rows, err := workbook.GetRows(workbook.GetSheetName(0))
+	if err != nil {
+		return nil, err
+	}
+	for len(rows) > 0 && strings.TrimSpace(strings.Join(rows[len(rows)-1], "")) == "" {
+		rows = rows[:len(rows)-1]
+	}
+	records := [][]string{}
+	for _, row := range rows {
+		if len(records) > 0 && len(row) < len(records[0]) {
+			row = append(row, make([]string, len(records[0])-len(row))...)
+		}
+		records = append(records, row)
+	}
+	return records, nil
+}
+
 // WriteCSV writes the given CSV data to the given file path.
 // It returns a channel that can be used to wait for the write to complete.
 // Saving a copy of csv uploads is low priority and thus does not panic on errors
@@ -58,54 +102,36 @@ func WriteCSV(filePath string, csvData [][]string) <-chan bool {
 	return done
 }
 
-// ValidateClientIPHandler validates the IP address of the user to ensure it matches the config and returns a boolean indication and error.
-// It returns true if the IP address is valid, false if it is not, and an error if one occurs.
-// It is used to ensure that users are on the appropriate WIFI before checking in.
-func ValidateClientIPHandler(r *http.Request) (bool, error) {
-	IPAddress := r.Header.Get("X-Real-Ip")
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("X-Forwarded-For")
-	}
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("CF-Connecting-IP")
-	}
-	if IPAddress == "" {
-		IPAddress = r.RemoteAddr
+// GetEnvDuration returns the duration configured in the given env, such as "30m" or "12h".
+// It returns the fallback if the env is unset or is not a valid positive duration.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
 	}
 
-	// unable to verify IP address
-	if IPAddress == "" {
-		return false, nil
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		logger.Println(fmt.Sprintf("Invalid duration for %s: %q, using %s", key, value, fallback))
+		return fallback
 	}
 
-	// validate IP
-	addressSlice := strings.Split(IPAddress, ".")
-	validIPSlice := strings.Split(os.Getenv("VALID_IP_ADDR"), ".")
+	return duration
+}
 
-	// check if address slice == x.x.x.x
-	if len(addressSlice) != 4 {
-		return false, nil
-	}
-	octetRange1, err := strconv.Atoi(addressSlice[2])
-	if err != nil {
-		logger.Println(err)
-		return false, err
-	}
-	octetRange2, err := strconv.Atoi(addressSlice[3])
-	if err != nil {
-		logger.Println(err)
-		return false, err
+// GetEnvInt returns the positive integer configured in the given env.
+// It returns the fallback if the env is unset or is not a valid positive integer.
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
 	}
 
-	// validate address
-	if addressSlice[0] == validIPSlice[0] &&
-		addressSlice[1] == validIPSlice[1] &&
-		octetRange1 >= 0 && octetRange1 <= 255 &&
-		octetRange2 >= 0 && octetRange2 <= 255 {
-		return true, nil
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		logger.Println(fmt.Sprintf("Invalid number for %s: %q, using %d", key, value, fallback))
+		return fallback
 	}
 
-	// IP not in range
-	return false, nil
-
+	return number
 }